@@ -1,5 +1,7 @@
 module github.com/openconfig/testt
 
-go 1.17
+go 1.20
 
 require github.com/google/go-cmp v0.5.7
+
+require golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
@@ -16,66 +16,2402 @@
 package testt
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand"
+	"os"
 	"reflect"
+	"regexp"
 	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
-// ExpectFatal fails the test if the specified function does _not_ fail fatally,
-// i.e. does not call any of t.{FailNow, Fatal, Fatalf}.
-// If it does fail fatally, returns the fatal error message it logged.
-// It is recommended the error message be checked to distinguish the
-// expected failure from unrelated failures that may have occurred.
-func ExpectFatal(t testing.TB, fn func(t testing.TB)) string {
+// ExpectFatal fails the test if the specified function does _not_ fail fatally,
+// i.e. does not call any of t.{FailNow, Fatal, Fatalf}.
+// If it does fail fatally, returns the fatal error message it logged.
+// It is recommended the error message be checked to distinguish the
+// expected failure from unrelated failures that may have occurred.
+func ExpectFatal(t testing.TB, fn func(t testing.TB)) string {
+	t.Helper()
+	if msg := CaptureFatal(t, fn); msg != nil {
+		return *msg
+	}
+	t.Fatalf("%s did not fail fatally as expected", funcName(fn))
+	return ""
+}
+
+// ExpectFatalNoInternalTypes is like ExpectFatal but additionally fails the
+// test if the fatal error message references an unexported type of the package
+// identified by pkgPrefix, e.g. "testt" for "*testt.fakeT". This is a heuristic
+// that matches pkgPrefix followed by a dot and a lower-case identifier.
+func ExpectFatalNoInternalTypes(t testing.TB, pkgPrefix string, fn func(t testing.TB)) string {
+	t.Helper()
+	msg := ExpectFatal(t, fn)
+	re := regexp.MustCompile(regexp.QuoteMeta(pkgPrefix) + `\.[a-z_][A-Za-z0-9_]*`)
+	if ref := re.FindString(msg); ref != "" {
+		t.Fatalf("%s fatal message %q references internal type %s", funcName(fn), msg, ref)
+	}
+	return msg
+}
+
+// ExpectFailNowOnFirst is like ExpectFatal but additionally fails the test if
+// the specified function raised any errors after failing fatally, which would
+// indicate that it kept checking, e.g. from goroutines it spawned, rather than
+// stopping at the first failed check.
+func ExpectFailNowOnFirst(t testing.TB, fn func(t testing.TB)) string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	msg := ft.run(fn)
+	if msg == nil {
+		t.Fatalf("%s did not fail fatally as expected", funcName(fn))
+		return ""
+	}
+	var failed bool
+	for _, e := range ft.timeline {
+		switch {
+		case e.kind == fatalEvent:
+			failed = true
+		case failed && e.kind == errorEvent:
+			t.Fatalf("%s raised error %q after failing fatally with %q", funcName(fn), e.msg, *msg)
+		}
+	}
+	return *msg
+}
+
+// ExpectFatalSameGoroutine is like ExpectFatal but additionally fails the test
+// if the specified function failed fatally from a goroutine other than the one
+// it was called on. Outside of this function, such a failure panics on a
+// goroutine that nothing recovers and so crashes the test binary; here the
+// offending goroutine is instead stopped with runtime.Goexit, as testing.T
+// does, so that the failure can be reported cleanly. The check is best-effort:
+// the function must still wait for its goroutines to finish.
+func ExpectFatalSameGoroutine(t testing.TB, fn func(t testing.TB)) string {
+	t.Helper()
+	ft := &fakeT{realT: t, goid: goroutineID()}
+	msg := ft.run(fn)
+	if ft.foreignFatal {
+		t.Fatalf("%s failed fatally from a spawned goroutine; call t.Fatal only from the goroutine running the test", funcName(fn))
+		return ""
+	}
+	if msg == nil {
+		t.Fatalf("%s did not fail fatally as expected", funcName(fn))
+		return ""
+	}
+	return *msg
+}
+
+// goroutineID returns the id of the calling goroutine, as reported in the
+// header of its stack trace.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// The trace starts with "goroutine <id> [<state>]:".
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return 0
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// ExpectFatalOnNil is like ExpectFatal, but is intended for testing how a
+// helper handles nil inputs and additionally fails the test unless the fatal
+// error message mentions "nil".
+func ExpectFatalOnNil(t testing.TB, fn func(t testing.TB)) string {
+	t.Helper()
+	return ExpectFatalOnNilMentioning(t, "nil", fn)
+}
+
+// ExpectFatalOnNilMentioning is like ExpectFatalOnNil but requires the fatal
+// error message to mention substr rather than "nil".
+func ExpectFatalOnNilMentioning(t testing.TB, substr string, fn func(t testing.TB)) string {
+	t.Helper()
+	msg := ExpectFatal(t, fn)
+	if !strings.Contains(msg, substr) {
+		t.Fatalf("%s fatal message %q does not mention %q", funcName(fn), msg, substr)
+	}
+	return msg
+}
+
+// ExpectFatalAnyOf is like ExpectFatal but additionally fails the test unless
+// the fatal error message matches at least one of patterns. Returns the index
+// of the first matching pattern along with the message.
+func ExpectFatalAnyOf(t testing.TB, patterns []*regexp.Regexp, fn func(t testing.TB)) (int, string) {
+	t.Helper()
+	msg := ExpectFatal(t, fn)
+	for i, re := range patterns {
+		if re.MatchString(msg) {
+			return i, msg
+		}
+	}
+	t.Fatalf("%s fatal message %q matches none of %v", funcName(fn), msg, patterns)
+	return -1, msg
+}
+
+// ExpectFatalDeterministicWithDeps calls the specified function runs times,
+// each time with fresh dependencies constructed by makeDeps, and fails the
+// test unless it failed fatally with the same message every time. Since no
+// dependencies are shared between runs, any variation is attributable to the
+// function itself. Returns the fatal error message.
+func ExpectFatalDeterministicWithDeps[D any](t testing.TB, makeDeps func() D, runs int, fn func(t testing.TB, d D)) string {
+	t.Helper()
+	if runs < 1 {
+		t.Fatalf("ExpectFatalDeterministicWithDeps got %d runs, want at least 1", runs)
+	}
+	var first string
+	for i := 0; i < runs; i++ {
+		d := makeDeps()
+		msg := ExpectFatal(t, func(t testing.TB) { fn(t, d) })
+		if i == 0 {
+			first = msg
+		} else if msg != first {
+			t.Fatalf("%s failed fatally with %q in run %d, but with %q in run 1", funcName(fn), msg, i+1, first)
+		}
+	}
+	return first
+}
+
+// ExpectFatalMessageCanonical is like ExpectFatal but returns the fatal error
+// message after applying canonicalize to it. This allows golden comparisons
+// of messages to ignore formatting that is not stable, such as the way %v
+// formats values of complex types in different Go versions.
+func ExpectFatalMessageCanonical(t testing.TB, canonicalize func(string) string, fn func(t testing.TB)) string {
+	t.Helper()
+	return canonicalize(ExpectFatal(t, fn))
+}
+
+// ExpectFatalAfterFullScan is like ExpectFatal but additionally fails the test
+// unless the specified function visited each of its inputCount inputs, by
+// calling the provided visit callback with the index of each, before it failed
+// fatally. This verifies that a helper reports all problems rather than
+// aborting at the first.
+func ExpectFatalAfterFullScan(t testing.TB, inputCount int, fn func(t testing.TB, visit func(i int))) string {
+	t.Helper()
+	var mu sync.Mutex
+	visited := make(map[int]bool)
+	visit := func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		visited[i] = true
+	}
+	msg := ExpectFatal(t, func(t testing.TB) { fn(t, visit) })
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < inputCount; i++ {
+		if !visited[i] {
+			t.Fatalf("%s failed fatally with %q before visiting input %d of %d", funcName(fn), msg, i, inputCount)
+		}
+	}
+	return msg
+}
+
+// ExpectRecoveredFatal calls the specified function with a risky callback
+// that panics by calling triggerPanic, and fails the test unless the function
+// recovers the panic and fails fatally with a message that mentions the panic
+// value. Returns the fatal error message.
+func ExpectRecoveredFatal(t testing.TB, triggerPanic func(), fn func(t testing.TB, risky func())) string {
+	t.Helper()
+	var panicked interface{}
+	risky := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = r
+				panic(r)
+			}
+		}()
+		triggerPanic()
+	}
+	var msg *string
+	escaped := func() (r interface{}) {
+		defer func() {
+			r = recover()
+		}()
+		msg = CaptureFatal(t, func(t testing.TB) { fn(t, risky) })
+		return nil
+	}()
+	switch {
+	case escaped != nil:
+		t.Fatalf("%s did not recover from panic: %v", funcName(fn), escaped)
+	case msg == nil:
+		t.Fatalf("%s did not fail fatally as expected", funcName(fn))
+	case panicked == nil:
+		t.Fatalf("%s failed fatally with %q without calling risky", funcName(fn), *msg)
+	case !strings.Contains(*msg, fmt.Sprint(panicked)):
+		t.Fatalf("%s fatal message %q does not mention the recovered panic %q", funcName(fn), *msg, fmt.Sprint(panicked))
+	default:
+		return *msg
+	}
+	return ""
+}
+
+// ExpectDistinctFatals calls the specified function with each of inA and inB,
+// expecting it to fail fatally both times, and fails the test if the two fatal
+// error messages are identical. This catches helpers whose error messages do
+// not identify the input that caused them. Returns both messages.
+func ExpectDistinctFatals(t testing.TB, inA, inB string, fn func(t testing.TB, in string)) (string, string) {
+	t.Helper()
+	msgA := ExpectFatal(t, func(t testing.TB) { fn(t, inA) })
+	msgB := ExpectFatal(t, func(t testing.TB) { fn(t, inB) })
+	if msgA == msgB {
+		t.Fatalf("%s failed fatally with the same message %q for inputs %q and %q", funcName(fn), msgA, inA, inB)
+	}
+	return msgA, msgB
+}
+
+// ordered is satisfied by the types that support the < operator.
+type ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+// ExpectFatalAtBoundary calls the specified function with belowBoundary,
+// which must be less than atBoundary, and with atBoundary, and fails the test
+// unless it fails fatally for atBoundary but not for belowBoundary. This pins
+// down the exact point at which a helper starts rejecting its input, catching
+// off-by-one errors. Returns the fatal error message for atBoundary.
+func ExpectFatalAtBoundary[T ordered](t testing.TB, belowBoundary, atBoundary T, fn func(t testing.TB, v T)) string {
+	t.Helper()
+	if !(belowBoundary < atBoundary) {
+		t.Fatalf("ExpectFatalAtBoundary got belowBoundary %v, want less than atBoundary %v", belowBoundary, atBoundary)
+		return ""
+	}
+	if msg := CaptureFatal(t, func(t testing.TB) { fn(t, belowBoundary) }); msg != nil {
+		t.Fatalf("%s failed fatally below the boundary, for %v: %s", funcName(fn), belowBoundary, *msg)
+		return ""
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, atBoundary) })
+	if msg == nil {
+		t.Fatalf("%s did not fail fatally at the boundary, for %v", funcName(fn), atBoundary)
+		return ""
+	}
+	return *msg
+}
+
+// ExpectFatalHasCode fails the test unless the specified function fails
+// fatally with a message containing an error code matching codePattern, such
+// as `E\d{4}`. Returns the fatal error message and the first code in it.
+func ExpectFatalHasCode(t testing.TB, codePattern *regexp.Regexp, fn func(testing.TB)) (string, string) {
+	t.Helper()
+	msg := ExpectFatal(t, fn)
+	code := codePattern.FindString(msg)
+	if code == "" {
+		t.Fatalf("%s fatal message %q has no error code matching %v", funcName(fn), msg, codePattern)
+	}
+	return msg, code
+}
+
+// ExpectFatalMentionsInput calls the specified function with input,
+// expecting it to fail fatally, and fails the test unless the fatal error
+// message contains input, either verbatim or quoted as by %q. This ensures the
+// message tells the reader which input was at fault. Returns the message.
+func ExpectFatalMentionsInput(t testing.TB, input string, fn func(t testing.TB, in string)) string {
+	t.Helper()
+	msg := ExpectFatal(t, func(t testing.TB) { fn(t, input) })
+	if !strings.Contains(msg, input) && !strings.Contains(msg, strconv.Quote(input)) {
+		t.Fatalf("%s fatal message %q does not mention its input %q", funcName(fn), msg, input)
+	}
+	return msg
+}
+
+// ExpectHelperInAllFrames runs the specified function and fails the test if
+// any function that it called, directly or indirectly, on the path to raising
+// an error or fatal failure did not call t.Helper. This is a heuristic based on
+// the call stacks recorded when the error or failure was raised: it only
+// considers frames on the goroutine running the function, between it and the
+// reporting call, and identifies them by function name.
+func ExpectHelperInAllFrames(t testing.TB, fn func(testing.TB)) {
+	t.Helper()
+	ft := &fakeT{realT: t, helpers: make(map[string]bool), fnName: funcName(fn)}
+	ft.run(fn)
+	for _, e := range ft.timeline {
+		for _, frame := range e.frames {
+			if !ft.helpers[frame] {
+				t.Fatalf("%s reported %q via %s, which did not call t.Helper", funcName(fn), e.msg, frame)
+			}
+		}
+	}
+}
+
+// ExpectHelperNoSideEffect runs the specified function twice, once with a
+// testing.TB whose Helper method records its callers and once with one whose
+// Helper method is a noop, and fails the test if the two runs raised different
+// errors or fatal failures. This proves that the function's use of t.Helper
+// does not alter its outcome.
+func ExpectHelperNoSideEffect(t testing.TB, fn func(testing.TB)) {
+	t.Helper()
+	tracking := &fakeT{realT: t, helpers: make(map[string]bool), fnName: funcName(fn)}
+	trackingMsg := tracking.run(fn)
+	noop := &fakeT{realT: t}
+	noopMsg := noop.run(fn)
+	if !reflect.DeepEqual(trackingMsg, noopMsg) || !reflect.DeepEqual(tracking.errs, noop.errs) {
+		t.Fatalf("%s outcome depends on t.Helper: with recording Helper got fatal %v and errors %q, with noop Helper got fatal %v and errors %q",
+			funcName(fn), fmtMsg(trackingMsg), tracking.errs, fmtMsg(noopMsg), noop.errs)
+	}
+}
+
+// CaptureFatal returns fatal error message if the specified function fails
+// fatally, i.e. calls any of t.{FailNow, Fatal, Fatalf}.
+// If it does fail fatally, returns the fatal error message it logged.
+func CaptureFatal(t testing.TB, fn func(t testing.TB)) (msg *string) {
+	t.Helper()
+	return (&fakeT{realT: t}).run(fn)
+}
+
+// run calls fn with the fakeT and returns the fatal error message if fn fails
+// fatally, i.e. calls any of t.{FailNow, Fatal, Fatalf}. Any functions that fn
+// registered with t.Cleanup are called before run returns, and if fn did not
+// fail fatally but one of them did, its message is returned instead.
+func (ft *fakeT) run(fn func(testing.TB)) (msg *string) {
+	defer func() {
+		if m := ft.runCleanups(); msg == nil {
+			msg = m
+		}
+	}()
+	return captureFailure(func() { fn(ft) })
+}
+
+// captureFailure calls f and returns the fatal error message if it fails
+// fatally through a fakeT. Any other panic is re-raised.
+func captureFailure(f func()) (msg *string) {
+	// Defer and recover to capture the expected fatal message.
+	defer func() {
+		switch r := recover().(type) {
+		case failure:
+			// panic from fatal fakeT failure, return the message
+			m := string(r)
+			msg = &m
+		case nil:
+			// no panic at all, do nothing
+		default:
+			// another panic was detected, re-raise
+			panic(r)
+		}
+	}()
+	f()
+	return nil
+}
+
+// CaptureReentrant returns the fatal error message, if the specified function
+// fails fatally, along with the errors it raised. The function may store its
+// testing.TB and use it from callbacks that it invokes synchronously, including
+// nested ones: errors are recorded in the order they are raised, and a fatal
+// failure in a callback aborts the callback and the function that invoked it.
+// Calls made from spawned goroutines are not covered by this guarantee.
+func CaptureReentrant(t testing.TB, fn func(t testing.TB)) (msg *string, errs []string) {
+	t.Helper()
+	return CaptureAll(t, fn)
+}
+
+// CaptureAll returns the fatal error message, if the specified function fails
+// fatally, i.e. calls any of t.{FailNow, Fatal, Fatalf}, along with the errors
+// it raised before then, i.e. with t.Errorf or t.Error.
+func CaptureAll(t testing.TB, fn func(t testing.TB)) (fatal *string, errs []string) {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	fatal = ft.run(fn)
+	return fatal, ft.errs
+}
+
+// ExpectFatalDistinctFromErrors is like ExpectFatal but additionally fails the
+// test if the fatal error message repeats one of the errors raised before it,
+// ignoring any trailing newline, so that the fatal failure adds information.
+// Returns the errors and the fatal error message.
+func ExpectFatalDistinctFromErrors(t testing.TB, fn func(testing.TB)) (errs []string, fatal string) {
+	t.Helper()
+	msg, errs := CaptureAll(t, fn)
+	if msg == nil {
+		t.Fatalf("%s did not fail fatally as expected", funcName(fn))
+		return errs, ""
+	}
+	for _, err := range errs {
+		if strings.TrimSuffix(err, "\n") == strings.TrimSuffix(*msg, "\n") {
+			t.Fatalf("%s failed fatally with %q, repeating an earlier error", funcName(fn), *msg)
+		}
+	}
+	return errs, *msg
+}
+
+// CaptureWithSeed calls the specified function with a *rand.Rand seeded with
+// seed and returns the fatal error message, if it fails fatally, along with
+// the errors it raised. Helpers that draw their randomness from the provided
+// source produce reproducible outcomes for a given seed.
+func CaptureWithSeed(t testing.TB, seed int64, fn func(t testing.TB, rng *rand.Rand)) (msg *string, errs []string) {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	msg = ft.run(func(t testing.TB) { fn(t, rand.New(rand.NewSource(seed))) })
+	return msg, ft.errs
+}
+
+// ExpectSeedReproducible runs the specified function twice with the same seed
+// using CaptureWithSeed and fails the test if the two runs produced different
+// fatal error messages or errors.
+func ExpectSeedReproducible(t testing.TB, seed int64, fn func(t testing.TB, rng *rand.Rand)) {
+	t.Helper()
+	msg1, errs1 := CaptureWithSeed(t, seed, fn)
+	msg2, errs2 := CaptureWithSeed(t, seed, fn)
+	if !reflect.DeepEqual(msg1, msg2) || !reflect.DeepEqual(errs1, errs2) {
+		t.Fatalf("%s is not reproducible with seed %d: first run got fatal %v and errors %q, second run got fatal %v and errors %q",
+			funcName(fn), seed, fmtMsg(msg1), errs1, fmtMsg(msg2), errs2)
+	}
+}
+
+// fmtMsg formats an optional fatal error message for inclusion in a failure.
+func fmtMsg(msg *string) string {
+	if msg == nil {
+		return "<none>"
+	}
+	return strconv.Quote(*msg)
+}
+
+// CaptureMaxDepth calls the specified function, which must make its recursive
+// calls through the provided recurse callback, and returns the maximum
+// recursion depth it reached along with the fatal error message if it fails
+// fatally. The provided depth callback reports the current recursion depth,
+// which is 0 outside of any call to recurse.
+func CaptureMaxDepth(t testing.TB, fn func(t testing.TB, recurse func(func()), depth func() int)) (maxDepth int, msg *string) {
+	t.Helper()
+	var cur int
+	recurse := func(f func()) {
+		cur++
+		defer func() { cur-- }()
+		if cur > maxDepth {
+			maxDepth = cur
+		}
+		f()
+	}
+	depth := func() int { return cur }
+	msg = CaptureFatal(t, func(t testing.TB) { fn(t, recurse, depth) })
+	return maxDepth, msg
+}
+
+// CaptureIterationsToFatal calls the specified function, which must call the
+// provided tick callback once per iteration of its loop, and returns the number
+// of ticks before it failed fatally, or -1 if it never did.
+func CaptureIterationsToFatal(t testing.TB, fn func(t testing.TB, tick func())) int {
+	t.Helper()
+	var ticks int
+	tick := func() { ticks++ }
+	if msg := CaptureFatal(t, func(t testing.TB) { fn(t, tick) }); msg == nil {
+		return -1
+	}
+	return ticks
+}
+
+// ExpectFatalWithinIterations fails the test unless the specified function
+// fails fatally within max iterations, as counted by CaptureIterationsToFatal.
+// Returns the number of iterations it took.
+func ExpectFatalWithinIterations(t testing.TB, max int, fn func(t testing.TB, tick func())) int {
+	t.Helper()
+	n := CaptureIterationsToFatal(t, fn)
+	switch {
+	case n < 0:
+		t.Fatalf("%s did not fail fatally as expected", funcName(fn))
+	case n > max:
+		t.Fatalf("%s failed fatally after %d iterations, want at most %d", funcName(fn), n, max)
+	}
+	return n
+}
+
+// Observer records the interactions that a helper makes with its
+// dependencies, such as the requests it sends through an injected client.
+type Observer interface {
+	Record(event string)
+}
+
+// CaptureWithObserver calls the specified function with the provided observer
+// and returns the fatal error message if it fails fatally. This allows a test
+// to assert on both the interactions that a helper made, via a mock observer
+// supplied by the test, and the way that it failed.
+func CaptureWithObserver(t testing.TB, obs Observer, fn func(t testing.TB, obs Observer)) *string {
+	t.Helper()
+	return CaptureFatal(t, func(t testing.TB) { fn(t, obs) })
+}
+
+// CaptureFatalCtx calls the specified function with ctx and returns the fatal
+// error message if it fails fatally, along with the context error if ctx was
+// done by the time the function finished.
+func CaptureFatalCtx(ctx context.Context, t testing.TB, fn func(context.Context, testing.TB)) (*string, error) {
+	t.Helper()
+	msg := CaptureFatal(t, func(t testing.TB) { fn(ctx, t) })
+	return msg, ctx.Err()
+}
+
+// CaptureDrains calls the specified function with a closed channel holding
+// items and returns the fatal error message if it fails fatally. If the
+// function returns without failing fatally, CaptureDrains additionally fails
+// the test unless it received every item from the channel.
+func CaptureDrains[T any](t testing.TB, items []T, fn func(t testing.TB, ch <-chan T)) *string {
+	t.Helper()
+	ch := make(chan T, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	if msg := CaptureFatal(t, func(t testing.TB) { fn(t, ch) }); msg != nil {
+		return msg
+	}
+	if n := len(ch); n > 0 {
+		t.Fatalf("%s returned without consuming %d of %d items", funcName(fn), n, len(items))
+	}
+	return nil
+}
+
+// CaptureReaderError calls the specified function with r and returns the
+// fatal error message if it fails fatally. Pass a reader that fails, such as
+// one returned by iotest.ErrReader, to check that a helper reports read errors.
+func CaptureReaderError(t testing.TB, r io.Reader, fn func(t testing.TB, r io.Reader)) *string {
+	t.Helper()
+	return CaptureFatal(t, func(t testing.TB) { fn(t, r) })
+}
+
+// CaptureClosesCloser calls the specified function with a wrapper around c
+// and returns the fatal error message if it fails fatally. It additionally
+// fails the test unless the function, or a cleanup it registered with
+// t.Cleanup, closed the wrapper, whether or not it failed fatally. Closing the
+// wrapper closes c, unless c is nil.
+func CaptureClosesCloser(t testing.TB, c io.Closer, fn func(t testing.TB, c io.Closer)) *string {
+	t.Helper()
+	rc := &recordingCloser{c: c}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, rc) })
+	if !rc.wasClosed() {
+		t.Fatalf("%s did not close its io.Closer (fatal: %s)", funcName(fn), fmtMsg(msg))
+	}
+	return msg
+}
+
+// recordingCloser is the io.Closer provided by CaptureClosesCloser, which
+// records whether it was closed.
+type recordingCloser struct {
+	c io.Closer
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (rc *recordingCloser) Close() error {
+	rc.mu.Lock()
+	rc.closed = true
+	rc.mu.Unlock()
+	if rc.c == nil {
+		return nil
+	}
+	return rc.c.Close()
+}
+
+func (rc *recordingCloser) wasClosed() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closed
+}
+
+// CaptureReadOnlyFS calls the specified function with a read-only fs.FS
+// rooted at the testdata directory of the package under test, i.e. of the
+// working directory of the test binary, and returns the fatal error message if
+// it fails fatally. This allows a test to assert both that a helper reads
+// through its fs.FS rather than the OS and that it fails cleanly when it
+// needs to write but cannot.
+func CaptureReadOnlyFS(t testing.TB, fn func(t testing.TB, fsys fs.FS)) *string {
+	t.Helper()
+	fsys := os.DirFS("testdata")
+	return CaptureFatal(t, func(t testing.TB) { fn(t, fsys) })
+}
+
+// FakeClock is a clock whose time only moves when advanced, allowing helpers
+// with time-based logic, such as timeouts, to be tested without sleeping.
+type FakeClock interface {
+	// Now returns the current time of the clock.
+	Now() time.Time
+	// Advance moves the clock forward by d.
+	Advance(d time.Duration)
+}
+
+// fakeClock is the FakeClock implementation provided by CaptureWithFakeClock.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// CaptureWithFakeClock calls the specified function with a FakeClock and
+// returns the fatal error message if it fails fatally. The clock starts at the
+// Unix epoch.
+func CaptureWithFakeClock(t testing.TB, fn func(t testing.TB, clock FakeClock)) *string {
+	t.Helper()
+	clock := &fakeClock{now: time.Unix(0, 0).UTC()}
+	return CaptureFatal(t, func(t testing.TB) { fn(t, clock) })
+}
+
+// ExpectPromptReturn starts the specified function on a new goroutine with
+// ctx, cancels ctx immediately, without waiting for the function to make any
+// progress, and fails the test unless the function returns, or fails fatally,
+// within grace of the cancellation. Returns the measured delay between the cancellation and
+// the function returning. If the function panics, other than by failing
+// fatally, in time, the panic is re-raised. If the function does not return in
+// time, it is left running in the background.
+func ExpectPromptReturn(ctx context.Context, cancel context.CancelFunc, grace time.Duration, t testing.TB, fn func(context.Context, testing.TB)) time.Duration {
+	t.Helper()
+	done := goCaptureFatal(t, func(t testing.TB) { fn(ctx, t) })
+	cancel()
+	cancelled := time.Now()
+	select {
+	case c := <-done:
+		c.get()
+		return time.Since(cancelled)
+	case <-time.After(grace):
+		t.Fatalf("%s did not return within %v of context cancellation", funcName(fn), grace)
+		return 0
+	}
+}
+
+// deadlineGrace is how long after its context deadline a function may take to
+// return in ExpectHelperRespectsDeadline.
+const deadlineGrace = 100 * time.Millisecond
+
+// ExpectHelperRespectsDeadline calls the specified function with a context
+// whose deadline is within from now, and fails the test unless the function
+// returns, or fails fatally, shortly after the deadline at the latest. If the
+// function panics, other than by failing fatally, in time, the panic is
+// re-raised. If the function does not return in time, it is left running in
+// the background.
+func ExpectHelperRespectsDeadline(t testing.TB, within time.Duration, fn func(context.Context, testing.TB)) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), within)
+	defer cancel()
+	done := goCaptureFatal(t, func(t testing.TB) { fn(ctx, t) })
+	select {
+	case c := <-done:
+		c.get()
+	case <-time.After(within + deadlineGrace):
+		t.Fatalf("%s was still running %v after its %v context deadline", funcName(fn), deadlineGrace, within)
+	}
+}
+
+// waitGroupSettle is how long CaptureWithWaitGroup waits for the WaitGroup
+// counter to reach zero after the function under test returns.
+const waitGroupSettle = 50 * time.Millisecond
+
+// CaptureWithWaitGroup calls the specified function with a WaitGroup and
+// returns the fatal error message if it fails fatally, along with whether the
+// WaitGroup counter reached zero, i.e. every Add was matched by a Done, shortly
+// after the function returned. If it did not, a goroutine waiting on the
+// WaitGroup is left running until the counter reaches zero.
+func CaptureWithWaitGroup(t testing.TB, fn func(t testing.TB, wg *sync.WaitGroup)) (*string, bool) {
+	t.Helper()
+	var wg sync.WaitGroup
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, &wg) })
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return msg, true
+	case <-time.After(waitGroupSettle):
+		return msg, false
+	}
+}
+
+// goroutineSettle is how long ExpectAllGoroutinesJoined waits for the
+// goroutines started by the function under test to exit after it returns.
+const goroutineSettle = 100 * time.Millisecond
+
+// ExpectAllGoroutinesJoined calls the specified function and fails the test,
+// with a stack dump of the survivors, unless every goroutine it started has
+// exited shortly after it returned, i.e. unless the function joins everything
+// it spawns. Returns the fatal error message if the function fails fatally.
+//
+// Goroutines that were already running when the function was called are
+// ignored, whether or not they exit in the meantime. Goroutines are not
+// attributed to the function that started them, though, so any started in the
+// meantime by other code, such as tests calling t.Parallel, are reported as
+// survivors too.
+func ExpectAllGoroutinesJoined(t testing.TB, fn func(testing.TB)) *string {
+	t.Helper()
+	baseline := goroutineStacks()
+	msg := CaptureFatal(t, fn)
+	var survivors []string
+	for deadline := time.Now().Add(goroutineSettle); ; time.Sleep(time.Millisecond) {
+		survivors = survivors[:0]
+		for id, stack := range goroutineStacks() {
+			if _, ok := baseline[id]; !ok {
+				survivors = append(survivors, stack)
+			}
+		}
+		if len(survivors) == 0 {
+			return msg
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+	}
+	sort.Strings(survivors)
+	t.Fatalf("%s left %d goroutines running after %v:\n\n%s", funcName(fn), len(survivors), goroutineSettle, strings.Join(survivors, "\n\n"))
+	return msg
+}
+
+// goroutineStacks returns the stack traces of all goroutines, keyed by the
+// goroutine's ID.
+func goroutineStacks() map[string]string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := map[string]string{}
+	for _, stack := range strings.Split(strings.TrimSpace(string(buf)), "\n\n") {
+		// Each stack starts with a header of the form "goroutine 1 [running]:".
+		fields := strings.Fields(stack)
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		stacks[fields[1]] = stack
+	}
+	return stacks
+}
+
+// CapturePanic returns the value that the specified function panicked with,
+// or nil if it did not panic. Fatal failures, i.e. calls to t.{FailNow, Fatal,
+// Fatalf}, are not considered to be panics.
+func CapturePanic(t testing.TB, fn func(testing.TB)) (r interface{}) {
+	t.Helper()
+	defer func() {
+		r = recover()
+	}()
+	CaptureFatal(t, fn)
+	return nil
+}
+
+// ExpectConcurrentPanicFree calls the specified function concurrently from n
+// goroutines, each under CapturePanic, and fails the test if any of the calls
+// panicked.
+func ExpectConcurrentPanicFree(t testing.TB, n int, fn func(testing.TB)) {
+	t.Helper()
+	var (
+		mu     sync.Mutex
+		panics []interface{}
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r := CapturePanic(t, fn); r != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				panics = append(panics, r)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(panics) > 0 {
+		t.Fatalf("%s panicked in %d of %d concurrent calls: %v", funcName(fn), len(panics), n, panics)
+	}
+}
+
+// CaptureObserveParallelism calls the specified function, which must bracket
+// each unit of the work it parallelizes with calls to the provided enter and
+// leave callbacks, and returns the peak number of units that were in progress
+// at the same time.
+func CaptureObserveParallelism(t testing.TB, fn func(t testing.TB, enter, leave func())) int {
+	t.Helper()
+	peak, _ := observeParallelism(t, fn)
+	return peak
+}
+
+// CaptureScaling calls the specified function once for each of the worker
+// counts, bracketing its work as for CaptureObserveParallelism, and returns the
+// peak concurrency observed for each, along with the fatal error message, or
+// nil, for each. This allows a test to assert that a helper's parallelism
+// scales with its worker count.
+func CaptureScaling(t testing.TB, workers []int, fn func(t testing.TB, n int, enter, leave func())) ([]int, []*string) {
+	t.Helper()
+	peaks := make([]int, len(workers))
+	msgs := make([]*string, len(workers))
+	for i, n := range workers {
+		peaks[i], msgs[i] = observeParallelism(t, func(t testing.TB, enter, leave func()) { fn(t, n, enter, leave) })
+	}
+	return peaks, msgs
+}
+
+// observeParallelism calls fn with enter and leave callbacks that track the
+// number of units of work in progress, and returns the peak number along with
+// the fatal error message if fn fails fatally.
+func observeParallelism(t testing.TB, fn func(t testing.TB, enter, leave func())) (peak int, msg *string) {
+	t.Helper()
+	var mu sync.Mutex
+	var cur int
+	enter := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		cur++
+		if cur > peak {
+			peak = cur
+		}
+	}
+	leave := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		cur--
+	}
+	msg = CaptureFatal(t, func(t testing.TB) { fn(t, enter, leave) })
+	mu.Lock()
+	defer mu.Unlock()
+	return peak, msg
+}
+
+// ExpectLoggerSilent calls the specified function with a *log.Logger that
+// writes to a buffer and fails the test if anything was written to it. Returns
+// the fatal error message if the function fails fatally.
+func ExpectLoggerSilent(t testing.TB, fn func(t testing.TB, l *log.Logger)) *string {
+	t.Helper()
+	var buf bytes.Buffer
+	l := log.New(&buf, "", 0)
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, l) })
+	if buf.Len() > 0 {
+		t.Fatalf("%s wrote to its logger:\n%s", funcName(fn), buf.String())
+	}
+	return msg
+}
+
+// CaptureCtxValues calls the specified function with a context derived from
+// ctx and returns the fatal error message if it fails fatally. CaptureCtxValues
+// additionally fails the test unless the function looked up each of keys with
+// the Value method of the context.
+func CaptureCtxValues(ctx context.Context, keys []interface{}, t testing.TB, fn func(context.Context, testing.TB)) *string {
+	t.Helper()
+	rctx := &recordingContext{Context: ctx, read: make(map[interface{}]bool)}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(rctx, t) })
+	for _, key := range keys {
+		if !rctx.wasRead(key) {
+			t.Fatalf("%s did not read context value %v", funcName(fn), key)
+		}
+	}
+	return msg
+}
+
+// recordingContext is a context.Context that records the keys looked up with
+// its Value method.
+type recordingContext struct {
+	context.Context
+
+	mu   sync.Mutex
+	read map[interface{}]bool
+}
+
+func (c *recordingContext) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	c.read[key] = true
+	c.mu.Unlock()
+	return c.Context.Value(key)
+}
+
+func (c *recordingContext) wasRead(key interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read[key]
+}
+
+// cancelReasonKey is the context key under which CaptureCtxReason stores the
+// cancellation reason.
+type cancelReasonKey struct{}
+
+// CancelReason returns the reason for the cancellation of ctx, if it was
+// provided by CaptureCtxReason, or false otherwise.
+func CancelReason(ctx context.Context) (string, bool) {
+	reason, ok := ctx.Value(cancelReasonKey{}).(string)
+	return reason, ok
+}
+
+// CaptureCtxReason calls the specified function with a context derived from
+// ctx that carries reason, which the function can retrieve with CancelReason,
+// and that is already cancelled. Returns the messages that the function
+// logged, raised as errors or failed fatally with, in the order that it did
+// so. This allows a test to assert that a helper reports why it was
+// cancelled.
+func CaptureCtxReason(ctx context.Context, reason string, t testing.TB, fn func(context.Context, testing.TB)) []string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, cancelReasonKey{}, reason))
+	cancel()
+	ft := &fakeT{realT: t}
+	ft.run(func(t testing.TB) { fn(ctx, t) })
+	var msgs []string
+	for _, e := range ft.timeline {
+		msgs = append(msgs, e.msg)
+	}
+	return msgs
+}
+
+// Progress is a progress report made by a long-running helper, indicating
+// that it has reached item I of Total.
+type Progress struct {
+	I, Total int
+}
+
+// CaptureErrorProgress calls the specified function, which reports its
+// progress with the provided report callback, and returns the reports it made
+// in order, along with the fatal error message if it fails fatally.
+func CaptureErrorProgress(t testing.TB, fn func(t testing.TB, report func(i, total int))) ([]Progress, *string) {
+	t.Helper()
+	var mu sync.Mutex
+	var reports []Progress
+	report := func(i, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, Progress{I: i, Total: total})
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, report) })
+	mu.Lock()
+	defer mu.Unlock()
+	return reports, msg
+}
+
+// ExpectDefersRun calls the specified function, which must defer a call to the
+// provided ran callback, and fails the test unless the callback was called.
+// Returns the fatal error message if the function fails fatally.
+//
+// A real testing.T stops the test goroutine with runtime.Goexit when it fails
+// fatally, whereas the testing.TB provided here panics, and the panic is then
+// recovered. Either way, deferred functions run on the fatal path, so a helper
+// that relies on defer for cleanup behaves the same under both.
+func ExpectDefersRun(t testing.TB, fn func(t testing.TB, ran func())) *string {
+	t.Helper()
+	var called bool
+	ran := func() { called = true }
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, ran) })
+	if !called {
+		t.Fatalf("%s returned without running its deferred function", funcName(fn))
+	}
+	return msg
+}
+
+// CaptureWithResponses calls the specified function with a call callback that
+// returns the next of responses each time it is called, in the way that a stub
+// scripted with canned responses would. Returns the number of calls the
+// function made along with the fatal error message if it fails fatally. Making
+// more calls than there are responses fails the function fatally.
+func CaptureWithResponses[Req, Resp any](t testing.TB, responses []Resp, fn func(t testing.TB, call func(Req) Resp)) (int, *string) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls int
+	// next returns the index of the response for the next call, or false if
+	// they have all been used.
+	next := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls == len(responses) {
+			return calls, false
+		}
+		calls++
+		return calls - 1, true
+	}
+	msg := CaptureFatal(t, func(t testing.TB) {
+		call := func(req Req) Resp {
+			i, ok := next()
+			if !ok {
+				t.Fatalf("unexpected call %d with request %v: only %d responses provided", i+1, req, len(responses))
+			}
+			return responses[i]
+		}
+		fn(t, call)
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	return calls, msg
+}
+
+// CaptureWithValue calls the specified function with v and returns the fatal
+// error message if it fails fatally.
+func CaptureWithValue(t testing.TB, v interface{}, fn func(t testing.TB, v interface{})) *string {
+	t.Helper()
+	return CaptureFatal(t, func(t testing.TB) { fn(t, v) })
+}
+
+// ExpectFatalOnTypeMismatch calls the specified function with v, a value of a
+// type the function does not expect, and fails the test unless it fails
+// fatally with a message that names the type of v. Returns the message.
+func ExpectFatalOnTypeMismatch(t testing.TB, v interface{}, fn func(t testing.TB, v interface{})) string {
+	t.Helper()
+	msg := CaptureWithValue(t, v, fn)
+	if msg == nil {
+		t.Fatalf("%s did not fail fatally as expected for a value of type %T", funcName(fn), v)
+		return ""
+	}
+	if typ := fmt.Sprintf("%T", v); !strings.Contains(*msg, typ) {
+		t.Fatalf("%s fatal message %q does not mention the type %s", funcName(fn), *msg, typ)
+	}
+	return *msg
+}
+
+// CaptureWithMarkers calls the specified function, which calls the provided
+// mark callback at the branch points of interest, and returns the labels it
+// marked in order, along with the fatal error message if it fails fatally.
+// This allows a test to assert which path through a helper was taken.
+func CaptureWithMarkers(t testing.TB, fn func(t testing.TB, mark func(label string))) ([]string, *string) {
+	t.Helper()
+	var mu sync.Mutex
+	var labels []string
+	mark := func(label string) {
+		mu.Lock()
+		defer mu.Unlock()
+		labels = append(labels, label)
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, mark) })
+	mu.Lock()
+	defer mu.Unlock()
+	return labels, msg
+}
+
+// ExpectEventSequence calls the specified function, which calls the provided
+// emit callback as it moves through its states, and fails the test unless the
+// events it emitted match want exactly and in order. Returns the fatal error
+// message if the function fails fatally.
+func ExpectEventSequence(t testing.TB, want []string, fn func(t testing.TB, emit func(event string))) *string {
+	t.Helper()
+	got, msg := CaptureWithMarkers(t, fn)
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Fatalf("%s emitted unexpected events (-want +got):\n%s", funcName(fn), diff)
+	}
+	return msg
+}
+
+// CaptureWithIDSource calls the specified function with a nextID callback that
+// returns a deterministic sequence of unique IDs, "id-1", "id-2" and so on, and
+// returns every ID it handed out, in order, along with the fatal error message
+// if the function fails fatally. This allows a test to assert how many IDs a
+// helper generated and, by comparing against the IDs it used, that it did not
+// reuse any.
+func CaptureWithIDSource(t testing.TB, fn func(t testing.TB, nextID func() string)) ([]string, *string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ids []string
+	nextID := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		id := fmt.Sprintf("id-%d", len(ids)+1)
+		ids = append(ids, id)
+		return id
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, nextID) })
+	mu.Lock()
+	defer mu.Unlock()
+	return ids, msg
+}
+
+// CaptureMetrics calls the specified function with an inc callback standing in
+// for its metrics sink, and returns the sum of the deltas recorded for each
+// metric name, along with the fatal error message if the function fails
+// fatally. This allows a test to assert that a helper emits its metrics even
+// when it fails fatally.
+func CaptureMetrics(t testing.TB, fn func(t testing.TB, inc func(name string, delta float64))) (map[string]float64, *string) {
+	t.Helper()
+	var mu sync.Mutex
+	recorded := make(map[string]float64)
+	inc := func(name string, delta float64) {
+		mu.Lock()
+		defer mu.Unlock()
+		recorded[name] += delta
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, inc) })
+	mu.Lock()
+	defer mu.Unlock()
+	return recorded, msg
+}
+
+// CaptureResourceBalance calls the specified function, which acquires its
+// resources with the provided open callback and releases each by calling the
+// close function that open returned, and returns the number of resources still
+// open after it returned, along with the fatal error message if it failed
+// fatally. Closing a resource more than once has no further effect.
+func CaptureResourceBalance(t testing.TB, fn func(t testing.TB, open func() (close func()))) (int, *string) {
+	t.Helper()
+	var mu sync.Mutex
+	var balance int
+	open := func() func() {
+		mu.Lock()
+		defer mu.Unlock()
+		balance++
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				mu.Lock()
+				defer mu.Unlock()
+				balance--
+			})
+		}
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, open) })
+	mu.Lock()
+	defer mu.Unlock()
+	return balance, msg
+}
+
+// CaptureLockBalance calls the specified function, which brackets each of its
+// critical sections with calls to the provided lock and unlock callbacks, and
+// returns the number of locks still held after it returned, i.e. the number of
+// calls to lock not matched by a call to unlock, along with the fatal error
+// message if it failed fatally. This catches helpers that fail fatally while
+// holding a lock. The callbacks only count calls; they do not provide mutual
+// exclusion.
+func CaptureLockBalance(t testing.TB, fn func(t testing.TB, lock, unlock func())) (int, *string) {
+	t.Helper()
+	var held int64
+	lock := func() { atomic.AddInt64(&held, 1) }
+	unlock := func() { atomic.AddInt64(&held, -1) }
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, lock, unlock) })
+	return int(atomic.LoadInt64(&held)), msg
+}
+
+// ExpectNoResourceLeak calls the specified function as CaptureResourceBalance
+// does and fails the test if any resource was left open. Returns the fatal
+// error message if the function failed fatally.
+func ExpectNoResourceLeak(t testing.TB, fn func(t testing.TB, open func() (close func()))) *string {
+	t.Helper()
+	n, msg := CaptureResourceBalance(t, fn)
+	if n != 0 {
+		t.Fatalf("%s left %d resources open", funcName(fn), n)
+	}
+	return msg
+}
+
+// userCPUMetric is the runtime metric estimating the CPU time spent running
+// Go code, which CaptureCPUTime samples.
+const userCPUMetric = "/cpu/classes/user:cpu-seconds"
+
+// CaptureCPUTime calls the specified function and returns an estimate of the
+// CPU time spent running it and the wall-clock time it took, along with the
+// fatal error message if it fails fatally. Comparing the two distinguishes a
+// function that is slow because it computes from one that is slow because it
+// sleeps or blocks.
+//
+// This is best-effort: the CPU time is a process-wide estimate made by the
+// runtime, so it includes the work of any other goroutines running at the same
+// time, such as those of tests running in parallel and of the race detector,
+// along with runtime overhead such as the garbage collections that
+// CaptureCPUTime forces before and after calling the function to bring the
+// estimate up to date. Even a function that only sleeps may therefore be
+// charged a significant amount of CPU time; compare measurements against each
+// other rather than against absolute thresholds.
+func CaptureCPUTime(t testing.TB, fn func(testing.TB)) (cpu time.Duration, wall time.Duration, fatal *string) {
+	t.Helper()
+	before := userCPUSeconds()
+	start := time.Now()
+	fatal = CaptureFatal(t, fn)
+	wall = time.Since(start)
+	cpu = time.Duration((userCPUSeconds() - before) * float64(time.Second))
+	return cpu, wall, fatal
+}
+
+// userCPUSeconds returns the runtime's estimate of the CPU time spent running
+// Go code so far, in seconds.
+func userCPUSeconds() float64 {
+	runtime.GC()
+	sample := []metrics.Sample{{Name: userCPUMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return sample[0].Value.Float64()
+}
+
+// memorySampleInterval is how often CaptureWithMemoryBudget samples the heap.
+const memorySampleInterval = time.Millisecond
+
+// CaptureWithMemoryBudget calls the specified function and returns the fatal
+// error message if it fails fatally. It additionally fails the test if the
+// in-use heap grew by more than maxBytes over its size when the function was
+// called, at any point while the function ran.
+//
+// This is best-effort: the heap is sampled with runtime.ReadMemStats every
+// millisecond and once more after the function returns, so a short-lived peak
+// between samples may be missed, and the heap is measured for the whole
+// process, so allocations by other goroutines running at the same time count
+// against the budget. Memory that has become garbage counts until it is
+// collected.
+func CaptureWithMemoryBudget(t testing.TB, maxBytes uint64, fn func(testing.TB)) *string {
+	t.Helper()
+	runtime.GC()
+	baseline := heapAlloc()
+	var peak uint64
+	sample := func() {
+		if n := heapAlloc(); n > peak {
+			peak = n
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				sample()
+			}
+		}
+	}()
+	msg := func() *string {
+		// Stop the sampler even if fn panics or calls runtime.Goexit.
+		defer func() {
+			close(stop)
+			<-done
+		}()
+		return CaptureFatal(t, fn)
+	}()
+	sample()
+	if peak > baseline && peak-baseline > maxBytes {
+		t.Fatalf("%s grew the heap by %d bytes, want at most %d", funcName(fn), peak-baseline, maxBytes)
+	}
+	return msg
+}
+
+// heapAlloc returns the number of bytes of allocated heap objects.
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// CaptureWithFaultSchedule calls the specified function, which calls the
+// provided shouldFail callback at each operation that may fail, and returns
+// the fatal error message if it fails fatally. Each call to shouldFail returns
+// the next value of schedule, and false once the schedule is exhausted.
+func CaptureWithFaultSchedule(t testing.TB, schedule []bool, fn func(t testing.TB, shouldFail func() bool)) *string {
+	t.Helper()
+	var mu sync.Mutex
+	var next int
+	shouldFail := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if next == len(schedule) {
+			return false
+		}
+		next++
+		return schedule[next-1]
+	}
+	return CaptureFatal(t, func(t testing.TB) { fn(t, shouldFail) })
+}
+
+// CapturePartial starts the specified function on a new goroutine with ctx,
+// cancels ctx immediately, without waiting for the function to make any
+// progress, then waits for it to return and returns the partial results it
+// produced, along with the fatal error message if it failed fatally, in which
+// case there are no results. The function typically sees ctx as already
+// cancelled the first time it checks it, so its results are whatever it
+// completed before then. This allows a test to assert that a helper returns
+// what it completed, rather than nothing, when it is cancelled.
+func CapturePartial[T any](ctx context.Context, cancel context.CancelFunc, t testing.TB, fn func(context.Context, testing.TB) []T) ([]T, *string) {
+	t.Helper()
+	var results []T
+	done := goCaptureFatal(t, func(t testing.TB) { results = fn(ctx, t) })
+	cancel()
+	msg := (<-done).get()
+	return results, msg
+}
+
+// captured is the outcome of a call to CaptureFatal made by goCaptureFatal.
+type captured struct {
+	msg *string
+	// panicked records whether the function panicked, other than by failing
+	// fatally, with r.
+	panicked bool
+	r        interface{}
+}
+
+// get returns the fatal error message, re-raising any other panic on the
+// calling goroutine.
+func (c captured) get() *string {
+	if c.panicked {
+		panic(c.r)
+	}
+	return c.msg
+}
+
+// goCaptureFatal calls CaptureFatal with fn on a new goroutine and returns a
+// channel that receives the outcome once it returns. Panics other than fatal
+// failures are recovered, so that the caller can re-raise them with get rather
+// than them crashing the test binary.
+func goCaptureFatal(t testing.TB, fn func(testing.TB)) <-chan captured {
+	done := make(chan captured, 1)
+	go func() {
+		var c captured
+		// Also runs if fn calls runtime.Goexit.
+		defer func() { done <- c }()
+		defer func() {
+			if r := recover(); r != nil {
+				c.panicked, c.r = true, r
+			}
+		}()
+		c.msg = CaptureFatal(t, fn)
+	}()
+	return done
+}
+
+// CaptureCancelAtEachStep calls the specified function steps+1 times, each
+// time with a fresh context that is cancelled once the function has made k
+// calls to the provided step callback, for each k from 0 to steps, where 0
+// means the context is cancelled before the function is called. It fails the
+// test if the function panics, other than by failing fatally, for any k, and
+// otherwise returns the fatal error message, or nil, for each k. This fuzzes
+// the point at which a multi-step helper is cancelled, to check that it always
+// either completes or fails cleanly.
+func CaptureCancelAtEachStep(t testing.TB, steps int, fn func(ctx context.Context, t testing.TB, step func())) []*string {
+	t.Helper()
+	msgs := make([]*string, steps+1)
+	for k := range msgs {
+		ctx, cancel := context.WithCancel(context.Background())
+		var mu sync.Mutex
+		var calls int
+		step := func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if calls++; calls == k {
+				cancel()
+			}
+		}
+		if k == 0 {
+			cancel()
+		}
+		var r interface{}
+		func() {
+			defer func() {
+				r = recover()
+			}()
+			msgs[k] = CaptureFatal(t, func(t testing.TB) { fn(ctx, t, step) })
+		}()
+		cancel()
+		if r != nil {
+			t.Fatalf("%s panicked when cancelled after %d steps: %v", funcName(fn), k, r)
+		}
+	}
+	return msgs
+}
+
+// CaptureWithTicker calls the specified function with a channel that delivers
+// ticks times, as a time.Ticker channel would but without any real time
+// passing, and returns the fatal error message if it fails fatally. The
+// channel is closed after the last tick, so that a helper ranging over it
+// stops rather than blocking forever.
+func CaptureWithTicker(t testing.TB, ticks int, fn func(t testing.TB, tick <-chan time.Time)) *string {
+	t.Helper()
+	if ticks < 0 {
+		t.Fatalf("CaptureWithTicker got %d ticks, want at least 0", ticks)
+		return nil
+	}
+	ch := make(chan time.Time, ticks)
+	now := time.Now()
+	for i := 0; i < ticks; i++ {
+		ch <- now.Add(time.Duration(i) * time.Second)
+	}
+	close(ch)
+	return CaptureFatal(t, func(t testing.TB) { fn(t, ch) })
+}
+
+// CaptureInjectError calls the specified function with an op callback that
+// returns inject, standing in for a failing downstream operation, and fails
+// the test unless the function fails fatally with a message that includes the
+// text of inject, which must not be nil. Returns the fatal error message.
+func CaptureInjectError(t testing.TB, inject error, fn func(t testing.TB, op func() error)) *string {
+	t.Helper()
+	if inject == nil {
+		t.Fatalf("CaptureInjectError got nil error to inject, want non-nil")
+	}
+	op := func() error { return inject }
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, op) })
+	switch {
+	case msg == nil:
+		t.Fatalf("%s did not fail fatally on injected error %q", funcName(fn), inject)
+	case !strings.Contains(*msg, inject.Error()):
+		t.Fatalf("%s fatal message %q does not reference injected error %q", funcName(fn), *msg, inject)
+	}
+	return msg
+}
+
+// CaptureRetryCount calls the specified function with an attempt callback that
+// always reports failure, and returns the number of times the function called
+// it, i.e. how many attempts its retry policy made before it gave up, along
+// with the fatal error message if it failed fatally, as it should when it gives
+// up.
+func CaptureRetryCount(t testing.TB, fn func(t testing.TB, attempt func() bool)) (int, *string) {
+	t.Helper()
+	var attempts int64
+	attempt := func() bool {
+		atomic.AddInt64(&attempts, 1)
+		return false
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, attempt) })
+	return int(atomic.LoadInt64(&attempts)), msg
+}
+
+// ExpectRetries fails the test unless the specified function made exactly
+// want attempts, as counted by CaptureRetryCount, and then failed fatally.
+// Returns the fatal error message.
+func ExpectRetries(t testing.TB, want int, fn func(t testing.TB, attempt func() bool)) string {
+	t.Helper()
+	got, msg := CaptureRetryCount(t, fn)
+	if got != want {
+		t.Fatalf("%s made %d attempts, want %d", funcName(fn), got, want)
+		return ""
+	}
+	if msg == nil {
+		t.Fatalf("%s did not fail fatally after %d failed attempts", funcName(fn), got)
+		return ""
+	}
+	return *msg
+}
+
+// ExpectNoFatalInDryRun calls the specified function in dry-run mode, i.e.
+// with dryRun set to true, and fails the test if it failed fatally. The
+// function may still log or raise errors. Returns the errors it raised.
+func ExpectNoFatalInDryRun(t testing.TB, fn func(t testing.TB, dryRun bool)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	if msg := ft.run(func(t testing.TB) { fn(t, true) }); msg != nil {
+		t.Fatalf("%s failed fatally in dry-run mode: %s", funcName(fn), *msg)
+	}
+	return ft.errs
+}
+
+// CaptureArtifact calls the specified function with an emit callback through
+// which it produces its result artifact, such as a JSON report, and returns
+// everything it emitted, concatenated, along with the fatal error message if
+// it fails fatally. This allows a test to assert that a helper produces its
+// artifact even on the fatal path.
+func CaptureArtifact(t testing.TB, fn func(t testing.TB, emit func([]byte))) ([]byte, *string) {
+	t.Helper()
+	var mu sync.Mutex
+	var artifact []byte
+	emit := func(b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		artifact = append(artifact, b...)
+	}
+	msg := CaptureFatal(t, func(t testing.TB) { fn(t, emit) })
+	mu.Lock()
+	defer mu.Unlock()
+	return artifact, msg
+}
+
+// CaptureWithFlakiness calls the specified function with a flaky callback that
+// returns true with probability p, and returns the fatal error message if it
+// fails fatally. The callback draws from a source seeded with seed, so that a
+// given seed reproduces the same pattern of flakes.
+func CaptureWithFlakiness(t testing.TB, p float64, seed int64, fn func(t testing.TB, flaky func() bool)) *string {
+	t.Helper()
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+	flaky := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rng.Float64() < p
+	}
+	return CaptureFatal(t, func(t testing.TB) { fn(t, flaky) })
+}
+
+// CaptureSkip returns the skip message if the specified function skips the
+// test, i.e. calls any of t.{Skip, Skipf, SkipNow}, or panics with a value
+// recognized by a classifier registered with RegisterSkipClassifier.
+func CaptureSkip(t testing.TB, fn func(t testing.TB)) (msg *string) {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	defer ft.runCleanupsOrFatal(t, fn)
+	// Defer and recover to capture the skip message.
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if s, ok := r.(skip); ok {
+			m := string(s)
+			msg = &m
+			return
+		}
+		if m, ok := classifySkip(r); ok {
+			msg = &m
+			return
+		}
+		// not a skip, re-raise
+		panic(r)
+	}()
+	fn(ft)
+	return nil
+}
+
+// RetrySkip calls the specified function up to attempts times, waiting delay
+// between attempts, for as long as it skips, as determined by CaptureSkip.
+// Returns the last skip message if the function skipped on every attempt, or
+// nil once an attempt did not skip.
+func RetrySkip(t testing.TB, attempts int, delay time.Duration, fn func(testing.TB)) *string {
+	t.Helper()
+	if attempts < 1 {
+		t.Fatalf("RetrySkip got %d attempts, want at least 1", attempts)
+		return nil
+	}
+	var msg *string
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		if msg = CaptureSkip(t, fn); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+// skipClassifier is a function registered with RegisterSkipClassifier.
+type skipClassifier func(r interface{}) (string, bool)
+
+// skipClassifiers holds the functions registered with RegisterSkipClassifier.
+// They are held by pointer, so that each registration can be identified for
+// unregistering.
+var skipClassifiers struct {
+	mu  sync.RWMutex
+	fns []*skipClassifier
+}
+
+// RegisterSkipClassifier registers a function that CaptureSkip consults when
+// the function it runs panics with a value other than a testt skip. If the
+// classifier reports the panic value as handled, CaptureSkip treats the panic
+// as a skip with the returned message. This allows integrating third-party
+// testing adapters that signal a skip with their own panic types. Returns a
+// function that unregisters the classifier, e.g. for use with t.Cleanup.
+func RegisterSkipClassifier(classify func(r interface{}) (msg string, handled bool)) (unregister func()) {
+	c := skipClassifier(classify)
+	skipClassifiers.mu.Lock()
+	defer skipClassifiers.mu.Unlock()
+	skipClassifiers.fns = append(skipClassifiers.fns, &c)
+	return func() {
+		skipClassifiers.mu.Lock()
+		defer skipClassifiers.mu.Unlock()
+		for i, fn := range skipClassifiers.fns {
+			if fn == &c {
+				skipClassifiers.fns = append(skipClassifiers.fns[:i], skipClassifiers.fns[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// classifySkip returns the skip message for r from the first registered skip
+// classifier that handles it.
+func classifySkip(r interface{}) (string, bool) {
+	skipClassifiers.mu.RLock()
+	defer skipClassifiers.mu.RUnlock()
+	for _, classify := range skipClassifiers.fns {
+		if msg, ok := (*classify)(r); ok {
+			return msg, true
+		}
+	}
+	return "", false
+}
+
+func funcName(i interface{}) string {
+	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
+}
+
+// ExpectError determines whether t.Errorf or t.Error was called at least
+// once during a test, and returns the set of strings that were specified
+// as arguments to the error calls. Like a real testing.T, t.Error formats its
+// arguments as fmt.Sprintln does, so its messages end in a newline, whereas
+// t.Errorf messages are formatted as fmt.Sprintf does. Use ExpectErrorTrimmed
+// to compare messages regardless of which was called.
+func ExpectError(t testing.TB, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	defer ft.runCleanupsOrFatal(t, fn)
+	fn(ft)
+	if ft.errs == nil {
+		t.Fatalf("%s did not raise an error as was expected", funcName(fn))
+	}
+	return ft.errs
+}
+
+// ExpectNoLeftoverTempDirs runs the specified function, along with any
+// functions it registered with t.Cleanup, and fails the test if any of the
+// directories returned by its calls to t.TempDir still exist afterwards, e.g.
+// because a cleanup recreated one of them.
+func ExpectNoLeftoverTempDirs(t testing.TB, fn func(testing.TB)) {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for _, dir := range ft.tempDirs {
+		if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s left temporary directory %s behind after cleanup", funcName(fn), dir)
+		}
+	}
+}
+
+// ExpectErrorTrimmed is like ExpectError but returns the messages with any
+// trailing newline, such as the one appended by t.Error, removed.
+func ExpectErrorTrimmed(t testing.TB, fn func(testing.TB)) []string {
+	t.Helper()
+	errs := ExpectError(t, fn)
+	trimmed := make([]string, len(errs))
+	for i, err := range errs {
+		trimmed[i] = strings.TrimSuffix(err, "\n")
+	}
+	return trimmed
+}
+
+// ExpectErrorsHaveKey is like ExpectError but additionally fails the test
+// unless every error contains a key=value token for the given key, e.g.
+// "device=dut1" for key "device".
+func ExpectErrorsHaveKey(t testing.TB, key string, fn func(testing.TB)) []string {
+	t.Helper()
+	errs := ExpectError(t, fn)
+	for _, err := range errs {
+		if !hasKey(err, key) {
+			t.Fatalf("%s raised error %q without key %q", funcName(fn), err, key)
+		}
+	}
+	return errs
+}
+
+// ExpectErrorsHaveRemediation is like ExpectError but additionally fails the
+// test unless every error contains hintMarker, such as "try:", which
+// introduces a hint telling the user how to fix the problem.
+func ExpectErrorsHaveRemediation(t testing.TB, hintMarker string, fn func(testing.TB)) []string {
+	t.Helper()
+	errs := ExpectError(t, fn)
+	for _, err := range errs {
+		if !strings.Contains(err, hintMarker) {
+			t.Fatalf("%s raised error %q without a remediation hint %q", funcName(fn), err, hintMarker)
+		}
+	}
+	return errs
+}
+
+// hasKey reports whether msg contains a key=value token for key.
+func hasKey(msg, key string) bool {
+	for _, tok := range strings.Fields(msg) {
+		if kv := strings.SplitN(tok, "=", 2); len(kv) == 2 && kv[0] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpectNoRedundantErrors captures the errors raised by the specified
+// function, i.e. calls to t.Errorf or t.Error, and fails the test if any error
+// message is a substring of another, which indicates overlapping reporting of
+// the same problem. Returns the errors.
+func ExpectNoRedundantErrors(t testing.TB, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for i, a := range ft.errs {
+		for j, b := range ft.errs {
+			if i != j && strings.Contains(b, a) {
+				t.Fatalf("%s raised redundant errors: %q is contained in %q", funcName(fn), a, b)
+			}
+		}
+	}
+	return ft.errs
+}
+
+// CaptureErrorCountOverRuns calls the specified function runs times and
+// returns the number of errors, i.e. calls to t.Errorf or t.Error, that it
+// raised in each run.
+func CaptureErrorCountOverRuns(t testing.TB, runs int, fn func(testing.TB)) []int {
+	t.Helper()
+	if runs < 1 {
+		t.Fatalf("CaptureErrorCountOverRuns got %d runs, want at least 1", runs)
+		return nil
+	}
+	counts := make([]int, runs)
+	for i := range counts {
+		ft := &fakeT{realT: t}
+		ft.run(fn)
+		counts[i] = len(ft.errs)
+	}
+	return counts
+}
+
+// ExpectStableErrorCount calls the specified function runs times and fails
+// the test if it raised a different number of errors in any of the runs.
+// Returns the number of errors raised per run.
+func ExpectStableErrorCount(t testing.TB, runs int, fn func(testing.TB)) int {
+	t.Helper()
+	counts := CaptureErrorCountOverRuns(t, runs, fn)
+	for _, n := range counts {
+		if n != counts[0] {
+			t.Fatalf("%s raised a varying number of errors over %d runs: %v", funcName(fn), runs, counts)
+		}
+	}
+	if len(counts) == 0 {
+		return 0
+	}
+	return counts[0]
+}
+
+// CaptureErrorGrowth calls the specified function once with each of the input
+// sizes and returns the number of errors, i.e. calls to t.Errorf or t.Error,
+// that it raised for each.
+func CaptureErrorGrowth(t testing.TB, sizes []int, fn func(t testing.TB, n int)) []int {
+	t.Helper()
+	counts := make([]int, len(sizes))
+	for i, n := range sizes {
+		ft := &fakeT{realT: t}
+		ft.run(func(t testing.TB) { fn(t, n) })
+		counts[i] = len(ft.errs)
+	}
+	return counts
+}
+
+// ExpectErrorGrowthBounded calls the specified function once with each of the
+// input sizes and fails the test if, for any size n, it raised more than
+// maxFunc(n) errors. This catches validators whose output grows faster with
+// the size of their input than it should. Returns the number of errors raised
+// for each size.
+func ExpectErrorGrowthBounded(t testing.TB, sizes []int, maxFunc func(n int) int, fn func(t testing.TB, n int)) []int {
+	t.Helper()
+	counts := CaptureErrorGrowth(t, sizes, fn)
+	for i, n := range sizes {
+		if max := maxFunc(n); counts[i] > max {
+			t.Fatalf("%s raised %d errors for size %d, want at most %d", funcName(fn), counts[i], n, max)
+		}
+	}
+	return counts
+}
+
+// ExpectConsistentSeverity calls the specified function runs times and fails
+// the test if it failed fatally in some of the runs but not in others, e.g.
+// because whether a problem is reported with t.Fatal or t.Error depends on
+// timing. Unlike ExpectFatalDeterministicWithDeps, the messages may differ
+// between runs.
+func ExpectConsistentSeverity(t testing.TB, runs int, fn func(testing.TB)) {
+	t.Helper()
+	if runs < 1 {
+		t.Fatalf("ExpectConsistentSeverity got %d runs, want at least 1", runs)
+		return
+	}
+	outcomes := make([]string, runs)
+	var fatals int
+	for i := range outcomes {
+		fatal, errs := CaptureAll(t, fn)
+		switch {
+		case fatal != nil:
+			outcomes[i] = "fatal"
+			fatals++
+		case len(errs) > 0:
+			outcomes[i] = "error"
+		default:
+			outcomes[i] = "pass"
+		}
+	}
+	if fatals > 0 && fatals < runs {
+		t.Fatalf("%s failed fatally in %d of %d runs: %v", funcName(fn), fatals, runs, outcomes)
+	}
+}
+
+// ExpectNoLostErrors calls the specified function, which may raise errors from
+// multiple goroutines, and fails the test unless exactly expectedCount errors,
+// i.e. calls to t.Errorf or t.Error, were captured once it returned. The
+// function must wait for the goroutines it spawns before returning. Returns
+// the errors.
+func ExpectNoLostErrors(t testing.TB, expectedCount int, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	if len(ft.errs) != expectedCount {
+		t.Fatalf("%s raised %d errors, want %d", funcName(fn), len(ft.errs), expectedCount)
+	}
+	return ft.errs
+}
+
+// ExpectErrorPerInvalid calls the specified function with items and fails the
+// test unless it raised exactly one error, i.e. called t.Errorf or t.Error, for
+// each item for which invalid returns true. Returns the errors.
+func ExpectErrorPerInvalid[T any](t testing.TB, items []T, invalid func(T) bool, fn func(t testing.TB, items []T)) []string {
+	t.Helper()
+	var want int
+	for _, item := range items {
+		if invalid(item) {
+			want++
+		}
+	}
+	ft := &fakeT{realT: t}
+	ft.run(func(t testing.TB) { fn(t, items) })
+	if len(ft.errs) != want {
+		t.Fatalf("%s raised %d errors for %d invalid items, want one per invalid item: %q", funcName(fn), len(ft.errs), want, ft.errs)
+	}
+	return ft.errs
+}
+
+// ExpectDedupBehavior calls the specified function with withDupes, which must
+// contain at least one duplicate item, and returns the errors it raised, i.e.
+// calls to t.Errorf or t.Error. This allows a test to assert whether a helper
+// reports duplicate inputs or silently deduplicates them. Fails the test if
+// the function fails fatally.
+func ExpectDedupBehavior[T comparable](t testing.TB, withDupes []T, fn func(t testing.TB, items []T)) []string {
+	t.Helper()
+	if duplicates(withDupes) == 0 {
+		t.Fatalf("ExpectDedupBehavior got items %v, want at least one duplicate", withDupes)
+	}
+	ft := &fakeT{realT: t}
+	if msg := ft.run(func(t testing.TB) { fn(t, withDupes) }); msg != nil {
+		t.Fatalf("%s failed fatally on duplicate items: %s", funcName(fn), *msg)
+	}
+	return ft.errs
+}
+
+// ExpectErrorPerDuplicate is like ExpectDedupBehavior but additionally fails
+// the test unless the function raised exactly one error for each duplicate,
+// i.e. each item that is equal to an earlier one.
+func ExpectErrorPerDuplicate[T comparable](t testing.TB, withDupes []T, fn func(t testing.TB, items []T)) []string {
+	t.Helper()
+	errs := ExpectDedupBehavior(t, withDupes, fn)
+	if want := duplicates(withDupes); len(errs) != want {
+		t.Fatalf("%s raised %d errors for %d duplicate items, want one per duplicate: %q", funcName(fn), len(errs), want, errs)
+	}
+	return errs
+}
+
+// duplicates returns the number of items that are equal to an earlier item.
+func duplicates[T comparable](items []T) int {
+	var n int
+	seen := make(map[T]bool)
+	for _, item := range items {
+		if seen[item] {
+			n++
+		}
+		seen[item] = true
+	}
+	return n
+}
+
+// ExpectErrorsSubsetOf captures the errors raised by the specified function,
+// i.e. calls to t.Errorf or t.Error, and fails the test if any of them is not
+// exactly equal to one of the allowed messages. Returns the errors.
+func ExpectErrorsSubsetOf(t testing.TB, allowed []string, fn func(testing.TB)) []string {
+	t.Helper()
+	allow := make(map[string]bool)
+	for _, msg := range allowed {
+		allow[msg] = true
+	}
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for _, err := range ft.errs {
+		if !allow[err] {
+			t.Fatalf("%s raised error %q, which is not one of %q", funcName(fn), err, allowed)
+		}
+	}
+	return ft.errs
+}
+
+// quotedIdentRE matches an identifier quoted as by the %q verb, e.g. "eth0".
+var quotedIdentRE = regexp.MustCompile(`"([A-Za-z_][A-Za-z0-9_./-]*)"`)
+
+// ExpectErrorsReferenceOnly captures the errors raised by the specified
+// function, i.e. calls to t.Errorf or t.Error, and fails the test if any of
+// them references an entity not in names. This is a heuristic that considers
+// double-quoted identifiers, as formatted by %q, to be entity references.
+// Returns the errors.
+func ExpectErrorsReferenceOnly(t testing.TB, names []string, fn func(testing.TB)) []string {
+	t.Helper()
+	known := make(map[string]bool)
+	for _, name := range names {
+		known[name] = true
+	}
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for _, err := range ft.errs {
+		for _, m := range quotedIdentRE.FindAllStringSubmatch(err, -1) {
+			if !known[m[1]] {
+				t.Fatalf("%s raised error %q referencing unknown entity %q, want one of %q", funcName(fn), err, m[1], names)
+			}
+		}
+	}
+	return ft.errs
+}
+
+// ExpectSummaryError is like ExpectError but additionally fails the test
+// unless the last error matches summaryPattern and none of the earlier,
+// per-item, errors do. Returns the errors.
+func ExpectSummaryError(t testing.TB, summaryPattern *regexp.Regexp, fn func(testing.TB)) []string {
 	t.Helper()
-	if msg := CaptureFatal(t, fn); msg != nil {
-		return *msg
+	errs := ExpectError(t, fn)
+	if len(errs) == 0 {
+		return errs
+	}
+	last := len(errs) - 1
+	if !summaryPattern.MatchString(errs[last]) {
+		t.Fatalf("%s raised last error %q, want a summary matching %v", funcName(fn), errs[last], summaryPattern)
+		return errs
+	}
+	for _, err := range errs[:last] {
+		if summaryPattern.MatchString(err) {
+			t.Fatalf("%s raised summary error %q before its last error", funcName(fn), err)
+		}
+	}
+	return errs
+}
+
+// ExpectCleanupPerResource calls the specified function, which acquires its
+// resources with the provided open callback, and fails the test unless it
+// registered exactly one function with t.Cleanup for each resource it opened.
+// The open callback returns a unique name for each resource. Returns the fatal
+// error message if the function failed fatally.
+func ExpectCleanupPerResource(t testing.TB, fn func(t testing.TB, open func() string)) *string {
+	t.Helper()
+	var mu sync.Mutex
+	var opened int
+	open := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		opened++
+		return fmt.Sprintf("resource-%d", opened)
+	}
+	ft := &fakeT{realT: t}
+	msg := ft.run(func(t testing.TB) { fn(t, open) })
+	mu.Lock()
+	defer mu.Unlock()
+	if ft.numCleanups != opened {
+		t.Fatalf("%s registered %d cleanups for %d opened resources", funcName(fn), ft.numCleanups, opened)
+	}
+	return msg
+}
+
+// ExpectErrorsInInputOrder calls the specified function with items and fails
+// the test unless the errors it raised, i.e. calls to t.Errorf or t.Error,
+// refer to the items in input order. The key function extracts the index of
+// the item that an error refers to, and errors for which it returns false are
+// ignored. Returns the errors.
+func ExpectErrorsInInputOrder[T any](t testing.TB, items []T, key func(string) (int, bool), fn func(t testing.TB, items []T)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(func(t testing.TB) { fn(t, items) })
+	prev, prevErr := -1, ""
+	for _, err := range ft.errs {
+		i, ok := key(err)
+		if !ok {
+			continue
+		}
+		if i < prev {
+			t.Fatalf("%s raised error %q for item %d after error %q for item %d", funcName(fn), err, i, prevErr, prev)
+		}
+		prev, prevErr = i, err
+	}
+	return ft.errs
+}
+
+// ExpectErrorsTrimmed captures the errors raised by the specified function and
+// fails the test if any of them has leading or trailing whitespace. Note that
+// as for a real testing.T, the message of a call to t.Error is formatted as by
+// fmt.Sprintln, which appends a newline, so this fails for any use of t.Error;
+// use t.Errorf instead. Returns the errors.
+func ExpectErrorsTrimmed(t testing.TB, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for _, err := range ft.errs {
+		if strings.TrimSpace(err) != err {
+			t.Fatalf("%s raised error %q with leading or trailing whitespace", funcName(fn), err)
+		}
+	}
+	return ft.errs
+}
+
+// ExpectOneErrorPerSubject captures the errors raised by the specified
+// function, i.e. calls to t.Errorf or t.Error, and fails the test if more than
+// one of them is about the same subject, as extracted by subjectOf. Returns a
+// map from each subject to its error.
+func ExpectOneErrorPerSubject(t testing.TB, subjectOf func(string) string, fn func(testing.TB)) map[string]string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	bySubject := make(map[string]string)
+	for _, err := range ft.errs {
+		subject := subjectOf(err)
+		if prev, ok := bySubject[subject]; ok {
+			t.Fatalf("%s raised errors %q and %q for the same subject %q", funcName(fn), prev, err, subject)
+		}
+		bySubject[subject] = err
+	}
+	return bySubject
+}
+
+// ExpectNoFormatErrors captures the errors and any fatal failure raised by the
+// specified function and fails the test if any of their messages contains a
+// fmt error marker such as "%!s(int=5)", which indicates a misused formatting
+// verb. Returns the messages.
+func ExpectNoFormatErrors(t testing.TB, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	var msgs []string
+	for _, e := range ft.timeline {
+		if e.kind == logEvent {
+			continue
+		}
+		if strings.Contains(e.msg, "%!") {
+			t.Fatalf("%s reported malformed message %q", funcName(fn), e.msg)
+		}
+		msgs = append(msgs, e.msg)
+	}
+	return msgs
+}
+
+// ExpectErrorsParseable captures the errors raised by the specified function,
+// i.e. calls to t.Errorf or t.Error, and fails the test if parse returns an
+// error for any of them. This ensures that a helper's errors can be consumed by
+// a downstream parser, such as a logfmt decoder. Returns the errors.
+func ExpectErrorsParseable(t testing.TB, parse func(string) error, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for _, err := range ft.errs {
+		if perr := parse(err); perr != nil {
+			t.Fatalf("%s raised error %q that does not parse: %v", funcName(fn), err, perr)
+		}
+	}
+	return ft.errs
+}
+
+// ExpectErrorsSortedBy captures the errors raised by the specified function,
+// i.e. calls to t.Errorf or t.Error, and fails the test unless they are sorted
+// according to less, reporting the first pair that is out of order. Returns
+// the errors.
+func ExpectErrorsSortedBy(t testing.TB, less func(a, b string) bool, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for i := 1; i < len(ft.errs); i++ {
+		if less(ft.errs[i], ft.errs[i-1]) {
+			t.Fatalf("%s raised error %q after %q, want them sorted", funcName(fn), ft.errs[i], ft.errs[i-1])
+		}
+	}
+	return ft.errs
+}
+
+// ExpectErrorsForFixture loads the fixture file at fixturePath, calls the
+// specified function with its contents, and fails the test unless the errors
+// it raised, i.e. calls to t.Errorf or t.Error, match those recorded in the
+// adjacent golden file, fixturePath + ".errors.golden", as a JSON array. If the
+// test binary defines an -update flag and it is set, the golden file is
+// rewritten with the captured errors instead. Returns the errors.
+func ExpectErrorsForFixture(t testing.TB, fixturePath string, fn func(t testing.TB, data []byte)) []string {
+	t.Helper()
+	data, err := os.ReadFile(fixturePath)
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+	ft := &fakeT{realT: t}
+	ft.run(func(t testing.TB) { fn(t, data) })
+	goldenPath := fixturePath + ".errors.golden"
+	if updateGolden() {
+		golden, err := json.MarshalIndent(ft.errs, "", "  ")
+		if err != nil {
+			t.Fatalf("encoding golden errors: %v", err)
+		}
+		if err := os.WriteFile(goldenPath, append(golden, '\n'), 0o644); err != nil {
+			t.Fatalf("updating golden errors: %v", err)
+		}
+		return ft.errs
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("reading golden errors: %v", err)
+	}
+	var want []string
+	if err := json.Unmarshal(golden, &want); err != nil {
+		t.Fatalf("decoding golden errors %s: %v", goldenPath, err)
+	}
+	if diff := cmp.Diff(want, ft.errs, cmpopts.EquateEmpty()); diff != "" {
+		t.Fatalf("%s raised unexpected errors for fixture %s (-want +got):\n%s", funcName(fn), fixturePath, diff)
+	}
+	return ft.errs
+}
+
+// updateGolden reports whether the test binary defines an -update flag and it
+// is set.
+func updateGolden() bool {
+	f := flag.Lookup("update")
+	if f == nil {
+		return false
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	update, _ := getter.Get().(bool)
+	return update
+}
+
+// ExpectCommonErrorSubstring runs each of the specified functions and fails
+// the test unless every one of them raised at least one error, i.e. called
+// t.Errorf or t.Error, containing substr.
+func ExpectCommonErrorSubstring(t testing.TB, substr string, fns ...func(testing.TB)) {
+	t.Helper()
+	for _, fn := range fns {
+		ft := &fakeT{realT: t}
+		ft.run(fn)
+		if !containsSubstring(ft.errs, substr) {
+			t.Fatalf("%s did not raise an error containing %q, got errors %q", funcName(fn), substr, ft.errs)
+		}
+	}
+}
+
+// containsSubstring reports whether any of msgs contains substr.
+func containsSubstring(msgs []string, substr string) bool {
+	for _, msg := range msgs {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpectUniqueErrors fails the test unless the set of distinct errors raised
+// by the specified function, i.e. calls to t.Errorf or t.Error, is equal to
+// want, ignoring order and duplicates.
+func ExpectUniqueErrors(t testing.TB, want []string, fn func(testing.TB)) {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	opts := []cmp.Option{
+		cmpopts.EquateEmpty(),
+		cmpopts.SortSlices(func(a, b string) bool { return a < b }),
+	}
+	if diff := cmp.Diff(dedup(want), dedup(ft.errs), opts...); diff != "" {
+		t.Fatalf("%s raised unexpected unique errors (-want +got):\n%s", funcName(fn), diff)
+	}
+}
+
+// dedup returns msgs without duplicates, preserving the order of first
+// occurrence.
+func dedup(msgs []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, msg := range msgs {
+		if !seen[msg] {
+			seen[msg] = true
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// severityRE matches a leading severity token, such as "WARN:".
+var severityRE = regexp.MustCompile(`^\s*([A-Za-z]+):`)
+
+// CaptureErrorSeverities returns the number of errors raised by the specified
+// function, i.e. calls to t.Errorf or t.Error, for each severity. The severity
+// of an error is the token preceding a ':' at the start of its message, e.g.
+// "WARN" for "WARN: disk nearly full"; errors without one have severity "".
+func CaptureErrorSeverities(t testing.TB, fn func(testing.TB)) map[string]int {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	counts := make(map[string]int)
+	for _, err := range ft.errs {
+		counts[severity(err)]++
+	}
+	return counts
+}
+
+// ExpectNoSeverity fails the test if the specified function raised any error
+// with the given severity, as determined by CaptureErrorSeverities.
+func ExpectNoSeverity(t testing.TB, sev string, fn func(testing.TB)) {
+	t.Helper()
+	if n := CaptureErrorSeverities(t, fn)[sev]; n > 0 {
+		t.Fatalf("%s raised %d errors with severity %q", funcName(fn), n, sev)
+	}
+}
+
+// severity returns the leading severity token of msg, or "" if it has none.
+func severity(msg string) string {
+	if m := severityRE.FindStringSubmatch(msg); m != nil {
+		return m[1]
 	}
-	t.Fatalf("%s did not fail fatally as expected", funcName(fn))
 	return ""
 }
 
-// CaptureFatal returns fatal error message if the specified function fails
-// fatally, i.e. calls any of t.{FailNow, Fatal, Fatalf}.
-// If it does fail fatally, returns the fatal error message it logged.
-func CaptureFatal(t testing.TB, fn func(t testing.TB)) (msg *string) {
+// verbosityRE matches a leading verbosity prefix, such as "[V2]".
+var verbosityRE = regexp.MustCompile(`^\s*\[V(\d+)\]`)
+
+// CaptureLogsByVerbosity captures the lines logged by the specified function,
+// i.e. with t.Log or t.Logf, and returns them grouped by verbosity level, in
+// the order they were logged. The level of a line is given by a "[V<n>]"
+// prefix, e.g. 2 for "[V2] polling dut1"; lines without one have level 0.
+func CaptureLogsByVerbosity(t testing.TB, fn func(testing.TB)) map[int][]string {
 	t.Helper()
-	// Defer and recover to capture the expected fatal message.
-	defer func() {
-		switch r := recover().(type) {
-		case failure:
-			// panic from fatal fakeT failure, return the message
-			m := string(r)
-			msg = &m
-		case nil:
-			// no panic at all, do nothing
-		default:
-			// another panic was detected, re-raise
-			panic(r)
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	levels := make(map[int][]string)
+	for _, line := range ft.logs() {
+		v := verbosity(line)
+		levels[v] = append(levels[v], line)
+	}
+	return levels
+}
+
+// ExpectMaxVerbosity fails the test if the specified function logged any line
+// with a verbosity level, as parsed by CaptureLogsByVerbosity, above max.
+func ExpectMaxVerbosity(t testing.TB, max int, fn func(testing.TB)) {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for _, line := range ft.logs() {
+		if v := verbosity(line); v > max {
+			t.Fatalf("%s logged %q at verbosity %d, want at most %d", funcName(fn), line, v, max)
+		}
+	}
+}
+
+// verbosity returns the verbosity level given by the leading prefix of line,
+// or 0 if it has none.
+func verbosity(line string) int {
+	m := verbosityRE.FindStringSubmatch(line)
+	if m == nil {
+		return 0
+	}
+	v, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// ExpectNoDuplicateLogs captures the lines logged by the specified function,
+// i.e. with t.Log or t.Logf, and fails the test if any identical line was
+// logged more than once. Returns the logged lines.
+func ExpectNoDuplicateLogs(t testing.TB, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	logs := ft.logs()
+	seen := make(map[string]bool)
+	for _, line := range logs {
+		if seen[line] {
+			t.Fatalf("%s logged %q more than once", funcName(fn), line)
+		}
+		seen[line] = true
+	}
+	return logs
+}
+
+// ExpectLogSeverityMonotonic fails the test if the specified function logs a
+// line, i.e. with t.Log or t.Logf, with a lower severity than a line it logged
+// earlier. Severities are parsed as for CaptureErrorSeverities and ranked by
+// their position in order, lowest first; lines whose severity is not in order
+// are ignored.
+func ExpectLogSeverityMonotonic(t testing.TB, order []string, fn func(testing.TB)) {
+	t.Helper()
+	rank := make(map[string]int)
+	for i, sev := range order {
+		rank[sev] = i
+	}
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	var prev string
+	for _, line := range ft.logs() {
+		r, ok := rank[severity(line)]
+		if !ok {
+			continue
 		}
+		if prev != "" && r < rank[severity(prev)] {
+			t.Fatalf("%s logged %q after %q, want non-decreasing severity in order %q", funcName(fn), line, prev, order)
+		}
+		prev = line
+	}
+}
+
+// ExpectCleanupMayLog runs the specified function along with any functions it
+// registered with t.Cleanup, which may continue to use t, e.g. to log, and
+// fails the test if either panicked. Returns the lines logged with t.Log or
+// t.Logf, including those logged by the cleanups.
+func ExpectCleanupMayLog(t testing.TB, fn func(testing.TB)) []string {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	r := func() (r interface{}) {
+		defer func() {
+			r = recover()
+		}()
+		ft.run(fn)
+		return nil
 	}()
-	fn(&fakeT{realT: t})
-	return nil
+	if r != nil {
+		t.Fatalf("%s or its cleanups panicked: %v", funcName(fn), r)
+	}
+	return ft.logs()
 }
 
-func funcName(i interface{}) string {
-	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
+// ExpectLogBeforeError fails the test if the specified function reports an
+// error, i.e. calls any of t.{Error, Errorf, FailNow, Fatal, Fatalf}, without
+// first logging some context with t.Log or t.Logf.
+func ExpectLogBeforeError(t testing.TB, fn func(testing.TB)) {
+	t.Helper()
+	ft := &fakeT{realT: t}
+	ft.run(fn)
+	for _, e := range ft.timeline {
+		switch e.kind {
+		case logEvent:
+			return
+		case errorEvent, fatalEvent:
+			t.Fatalf("%s reported error %q before logging any context", funcName(fn), e.msg)
+		}
+	}
 }
 
-// ExpectError determines whether t.Errorf or t.Error was called at least
-// once during a test, and returns the set of strings that were specified
-// as arguments to the error calls.
-func ExpectError(t testing.TB, fn func(testing.TB)) []string {
+// ExpectFinalLogMatch fails the test unless the last line logged by the
+// specified function, i.e. with t.Log or t.Logf, matches re, such as a
+// "done: 3 passed, 1 failed" summary. Returns the last line.
+func ExpectFinalLogMatch(t testing.TB, re *regexp.Regexp, fn func(testing.TB)) string {
 	t.Helper()
 	ft := &fakeT{realT: t}
-	fn(ft)
-	if ft.errs == nil {
-		t.Fatalf("%s did not raise an error as was expected", funcName(fn))
+	ft.run(fn)
+	logs := ft.logs()
+	if len(logs) == 0 {
+		t.Fatalf("%s logged nothing, want a final line matching %v", funcName(fn), re)
+		return ""
 	}
-	return ft.errs
+	last := logs[len(logs)-1]
+	if !re.MatchString(last) {
+		t.Fatalf("%s logged final line %q, want a match for %v", funcName(fn), last, re)
+		return ""
+	}
+	return last
 }
 
 // ParallelFatal runs the provided functions in parallel. It waits for every
@@ -107,6 +2443,85 @@ func ParallelFatal(t testing.TB, fns ...func(testing.TB)) {
 	}
 }
 
+// ParallelError runs the provided functions in parallel. It waits for every
+// function to complete and returns the errors they raised, i.e. calls to
+// t.Errorf or t.Error, grouped by function in the order the functions were
+// provided. As for ParallelFatal, if any function fails fatally then it fails
+// fatally itself.
+func ParallelError(t testing.TB, fns ...func(testing.TB)) []string {
+	t.Helper()
+	// Results are indexed by position, as the same function may be provided
+	// more than once.
+	fnErrs := make([][]string, len(fns))
+	fatals := make([]*string, len(fns))
+	var wg sync.WaitGroup
+	for i, fn := range fns {
+		wg.Add(1)
+		go func(i int, fn func(testing.TB)) {
+			defer wg.Done()
+			ft := &fakeT{realT: t}
+			fatals[i] = ft.run(fn)
+			fnErrs[i] = ft.errs
+		}(i, fn)
+	}
+	wg.Wait()
+	var failed []string
+	for i, msg := range fatals {
+		if msg != nil {
+			failed = append(failed, fmt.Sprintf("%d (%s): %s", i, funcName(fns[i]), *msg))
+		}
+	}
+	if len(failed) > 0 {
+		t.Fatalf("ParallelError: %d functions failed fatally: %s", len(failed), strings.Join(failed, "; "))
+	}
+	var errs []string
+	for _, e := range fnErrs {
+		errs = append(errs, e...)
+	}
+	return errs
+}
+
+// ExpectSameOutcomeParallelAndSequential calls the specified function with
+// each of the inputs, first one at a time and then all in parallel with
+// ParallelError, and fails the test unless the same errors, in any order, were
+// raised both times. This catches helpers whose output is changed by
+// concurrent calls, such as through unintentionally shared state. Fails the
+// test if any call fails fatally.
+func ExpectSameOutcomeParallelAndSequential(t testing.TB, inputs []string, fn func(t testing.TB, in string)) {
+	t.Helper()
+	fns := make([]func(testing.TB), len(inputs))
+	var sequential []string
+	for i, in := range inputs {
+		in := in
+		fns[i] = func(t testing.TB) { fn(t, in) }
+		ft := &fakeT{realT: t}
+		if msg := ft.run(fns[i]); msg != nil {
+			t.Fatalf("%s failed fatally for input %q: %s", funcName(fn), in, *msg)
+		}
+		sequential = append(sequential, ft.errs...)
+	}
+	parallel := ParallelError(t, fns...)
+	if diff := cmp.Diff(sequential, parallel, cmpopts.SortSlices(func(a, b string) bool { return a < b }), cmpopts.EquateEmpty()); diff != "" {
+		t.Fatalf("%s raised different errors in parallel than sequentially (-sequential +parallel):\n%s", funcName(fn), diff)
+	}
+}
+
+// FakeID returns the unique id of t if it is a testing.TB provided by one of
+// the functions in this package, or false otherwise. Each function run by this
+// package, including each of those run concurrently by ParallelFatal or
+// ParallelError, is given its own testing.TB, which this allows custom
+// harnesses to verify.
+func FakeID(t testing.TB) (uint64, bool) {
+	ft, ok := t.(*fakeT)
+	if !ok {
+		return 0, false
+	}
+	return ft.ID(), true
+}
+
+// lastFakeID is the id most recently assigned to a fakeT.
+var lastFakeID uint64
+
 // fakeT is a testing.TB implementation that can be used as an input to unit tests
 // such that it is possible to check that the correct errors are raised.
 type fakeT struct {
@@ -114,14 +2529,131 @@ type fakeT struct {
 	testing.TB
 	realT testing.TB
 
+	// mu guards the fields below that are modified by the testing.TB methods,
+	// so that the function under test may call them from multiple goroutines.
+	mu sync.Mutex
+
 	// err is used to store the strings that are specified as arguments to
 	// Error and Errorf when it is called.
 	errs []string
+
+	// cleanups stores the functions registered with Cleanup, which are called
+	// in last added, first called order once the function under test returns.
+	// numCleanups counts the functions ever registered by the function under
+	// test, excluding those registered internally, such as by TempDir.
+	cleanups    []func()
+	numCleanups int
+
+	// tempDirs stores the directories returned by TempDir.
+	tempDirs []string
+
+	// goid, if non-zero, is the id of the goroutine that is expected to report
+	// any fatal failure. foreignFatal records whether a fatal failure was
+	// reported from a different goroutine.
+	goid         uint64
+	foreignFatal bool
+
+	// helpers, if non-nil, records the names of the functions that called
+	// Helper, and fnName is the name of the function under test.
+	helpers map[string]bool
+	fnName  string
+
+	// id uniquely identifies the fakeT, and is assigned on first use.
+	idOnce sync.Once
+	id     uint64
+
+	// timeline records the calls to Log, Error and Fatal methods in the order
+	// in which they were made.
+	timeline []event
+}
+
+// ID returns the unique id of the fakeT.
+func (ft *fakeT) ID() uint64 {
+	ft.idOnce.Do(func() {
+		ft.id = atomic.AddUint64(&lastFakeID, 1)
+	})
+	return ft.id
+}
+
+// eventKind identifies the kind of testing.TB method that produced an event.
+type eventKind int
+
+const (
+	logEvent eventKind = iota
+	errorEvent
+	fatalEvent
+)
+
+// event is a single call recorded in the fakeT timeline.
+type event struct {
+	kind eventKind
+	msg  string
+
+	// frames holds, if the fakeT is tracking helpers, the names of the
+	// functions between the function under test and the one that reported an
+	// error or fatal event, innermost first.
+	frames []string
+}
+
+// record appends an event of the given kind to the fakeT timeline and, if it is
+// an error, to errs.
+func (ft *fakeT) record(kind eventKind, msg string) {
+	e := event{kind: kind, msg: msg}
+	if ft.helpers != nil && kind != logEvent {
+		e.frames = ft.framesBelowFn()
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.timeline = append(ft.timeline, e)
+	if kind == errorEvent {
+		ft.errs = append(ft.errs, msg)
+	}
+}
+
+// logs returns the messages logged with Log and Logf, in order.
+func (ft *fakeT) logs() []string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	var logs []string
+	for _, e := range ft.timeline {
+		if e.kind == logEvent {
+			logs = append(logs, e.msg)
+		}
+	}
+	return logs
+}
+
+// fakeTMethodPrefix is the prefix of the names of the fakeT methods.
+var fakeTMethodPrefix = reflect.TypeOf(fakeT{}).PkgPath() + ".(*fakeT)."
+
+// framesBelowFn returns the names of the functions on the calling goroutine's
+// stack, excluding the fakeT methods at the top of it, up to but excluding the
+// function under test. Returns nil if the function under test is not on the
+// stack.
+func (ft *fakeT) framesBelowFn() []string {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+	var names []string
+	for {
+		frame, more := frames.Next()
+		switch {
+		case frame.Function == ft.fnName:
+			return names
+		case len(names) > 0 || !strings.HasPrefix(frame.Function, fakeTMethodPrefix):
+			names = append(names, frame.Function)
+		}
+		if !more {
+			return nil
+		}
+	}
 }
 
 // failure is a unique type to distinguish test failures from other panics.
 type failure string
 
+// skip is a unique type to distinguish test skips from other panics.
+type skip string
+
 // FailNow implements the testing.TB FailNow method so that the failure can be
 // retrieved by making the call within the lambda argument to ExpectFatal.
 func (ft *fakeT) FailNow() {
@@ -141,30 +2673,142 @@ func (ft *fakeT) Fatalf(format string, args ...interface{}) {
 }
 
 func (ft *fakeT) fatal(msg string) {
+	ft.record(fatalEvent, msg)
+	if ft.goid != 0 && goroutineID() != ft.goid {
+		// Nothing recovers a panic on this goroutine, so stop it instead.
+		ft.mu.Lock()
+		ft.foreignFatal = true
+		ft.mu.Unlock()
+		runtime.Goexit()
+	}
 	panic(failure(msg))
 }
 
+// SkipNow implements the testing.TB SkipNow method so that the skip can be
+// retrieved by making the call within the lambda argument to CaptureSkip.
+func (ft *fakeT) SkipNow() {
+	panic(skip(""))
+}
+
+// Skip implements the testing.TB Skip method so that the skip can be
+// retrieved by making the call within the lambda argument to CaptureSkip.
+func (ft *fakeT) Skip(args ...interface{}) {
+	panic(skip(fmt.Sprintln(args...)))
+}
+
+// Skipf implements the testing.TB Skipf method so that the skip can be
+// retrieved by making the call within the lambda argument to CaptureSkip.
+func (ft *fakeT) Skipf(format string, args ...interface{}) {
+	panic(skip(fmt.Sprintf(format, args...)))
+}
+
 // Log implements the testing.TB Log method by delegating to the real *testing.T.
 func (ft *fakeT) Log(args ...interface{}) {
+	ft.record(logEvent, fmt.Sprintln(args...))
 	ft.realT.Log(args...)
 }
 
 // Log implements the testing.TB Logf method by delegating to the real *testing.T.
 func (ft *fakeT) Logf(format string, args ...interface{}) {
+	ft.record(logEvent, fmt.Sprintf(format, args...))
 	ft.realT.Logf(format, args...)
 }
 
 // Errorf implements the testing.TB Errorf method, but rather than reporting the
 // error catches it in the errs field of the fakeT.
 func (ft *fakeT) Errorf(format string, args ...interface{}) {
-	ft.errs = append(ft.errs, fmt.Sprintf(format, args...))
+	ft.error(fmt.Sprintf(format, args...))
 }
 
 // Error implements the testing.TB Error method, but rather than reporting the
-// error catches it in the errs field of the fakeT.
+// error catches it in the errs field of the fakeT. As for a real testing.T,
+// its arguments are formatted as by fmt.Sprintln, which appends a newline.
 func (ft *fakeT) Error(args ...interface{}) {
-	ft.errs = append(ft.errs, fmt.Sprintln(args...))
+	ft.error(fmt.Sprintln(args...))
+}
+
+func (ft *fakeT) error(msg string) {
+	ft.record(errorEvent, msg)
+}
+
+// Cleanup implements the testing.TB Cleanup method by registering f to be
+// called once the function under test returns.
+func (ft *fakeT) Cleanup(f func()) {
+	ft.addCleanup(f)
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.numCleanups++
+}
+
+// addCleanup registers f to be called once the function under test returns,
+// without counting it as registered by the function under test.
+func (ft *fakeT) addCleanup(f func()) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.cleanups = append(ft.cleanups, f)
 }
 
-// Helper implements the testing.TB Helper method as a noop.
-func (*fakeT) Helper() {}
+// runCleanups calls the functions registered with Cleanup in last added, first
+// called order. As for a real testing.T, a cleanup that fails fatally does not
+// prevent the remaining ones from being called. Returns the fatal error
+// message of the first cleanup that failed fatally, if any.
+func (ft *fakeT) runCleanups() (msg *string) {
+	for {
+		ft.mu.Lock()
+		if len(ft.cleanups) == 0 {
+			ft.mu.Unlock()
+			return msg
+		}
+		last := len(ft.cleanups) - 1
+		f := ft.cleanups[last]
+		ft.cleanups = ft.cleanups[:last]
+		ft.mu.Unlock()
+		if m := captureFailure(f); msg == nil {
+			msg = m
+		}
+	}
+}
+
+// runCleanupsOrFatal calls runCleanups and fails t if one of the cleanups
+// registered by fn failed fatally.
+func (ft *fakeT) runCleanupsOrFatal(t testing.TB, fn func(testing.TB)) {
+	t.Helper()
+	if msg := ft.runCleanups(); msg != nil {
+		t.Fatalf("%s registered a cleanup that failed fatally: %s", funcName(fn), *msg)
+	}
+}
+
+// TempDir implements the testing.TB TempDir method by creating a new
+// directory that is removed once the function under test returns.
+func (ft *fakeT) TempDir() string {
+	dir, err := os.MkdirTemp("", "testt")
+	if err != nil {
+		ft.Fatalf("TempDir: %v", err)
+	}
+	ft.mu.Lock()
+	ft.tempDirs = append(ft.tempDirs, dir)
+	ft.mu.Unlock()
+	ft.addCleanup(func() {
+		if err := os.RemoveAll(dir); err != nil {
+			ft.Errorf("TempDir RemoveAll cleanup: %v", err)
+		}
+	})
+	return dir
+}
+
+// Helper implements the testing.TB Helper method. If the fakeT is tracking
+// helpers, it records the calling function, otherwise it is a noop.
+func (ft *fakeT) Helper() {
+	if ft.helpers == nil {
+		return
+	}
+	pc, _, _, ok := runtime.Caller(1)
+	if !ok {
+		return
+	}
+	frames := runtime.CallersFrames([]uintptr{pc})
+	frame, _ := frames.Next()
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.helpers[frame.Function] = true
+}
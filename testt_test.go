@@ -15,11 +15,29 @@
 package testt
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestFatalMsg(t *testing.T) {
@@ -208,3 +226,3221 @@ func TestParallelFatal(t *testing.T) {
 		}
 	})
 }
+
+func TestExpectLogBeforeError(t *testing.T) {
+	tests := []struct {
+		desc     string
+		fn       func(t testing.TB)
+		wantFail bool
+	}{{
+		desc: "no error",
+		fn:   func(t testing.TB) {},
+	}, {
+		desc: "log then error",
+		fn: func(t testing.TB) {
+			t.Log("checking input")
+			t.Errorf("bad input")
+		},
+	}, {
+		desc: "logf then fatal",
+		fn: func(t testing.TB) {
+			t.Logf("checking %s", "input")
+			t.Fatal("bad input")
+		},
+	}, {
+		desc: "error first",
+		fn: func(t testing.TB) {
+			t.Error("bad input")
+			t.Log("checking input")
+		},
+		wantFail: true,
+	}, {
+		desc: "fatal first",
+		fn: func(t testing.TB) {
+			t.Fatalf("bad input")
+		},
+		wantFail: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if !tt.wantFail {
+				ExpectLogBeforeError(t, tt.fn)
+				return
+			}
+			want := "before logging any context"
+			if got := ExpectFatal(t, func(t testing.TB) { ExpectLogBeforeError(t, tt.fn) }); !strings.Contains(got, want) {
+				t.Errorf("ExpectLogBeforeError got msg = %q, want substring %q", got, want)
+			}
+		})
+	}
+}
+
+func TestExpectCommonErrorSubstring(t *testing.T) {
+	t.Run("all mention substring", func(t *testing.T) {
+		ExpectCommonErrorSubstring(t, "out of range",
+			func(t testing.TB) { t.Errorf("port 70000 out of range") },
+			func(t testing.TB) {
+				t.Error("vlan missing")
+				t.Error("vlan 5000 out of range")
+			})
+	})
+
+	t.Run("one omits substring", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectCommonErrorSubstring(t, "out of range",
+				func(t testing.TB) { t.Errorf("port 70000 out of range") },
+				func(t testing.TB) { t.Errorf("vlan 5000 invalid") })
+		})
+		if want := "vlan 5000 invalid"; !strings.Contains(got, want) {
+			t.Errorf("ExpectCommonErrorSubstring got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureSkip(t *testing.T) {
+	msgEmpty := ""
+	msgSkip := "not supported\n"
+	msgSkipf := "not supported on v2"
+
+	tests := []struct {
+		desc    string
+		fn      func(t testing.TB)
+		wantMsg *string
+	}{{
+		desc:    "NoSkip",
+		fn:      func(t testing.TB) {},
+		wantMsg: nil,
+	}, {
+		desc: "SkipNow",
+		fn: func(t testing.TB) {
+			t.SkipNow()
+		},
+		wantMsg: &msgEmpty,
+	}, {
+		desc: "Skip",
+		fn: func(t testing.TB) {
+			t.Skip("not supported")
+		},
+		wantMsg: &msgSkip,
+	}, {
+		desc: "Skipf",
+		fn: func(t testing.TB) {
+			t.Skipf("not supported on %s", "v2")
+		},
+		wantMsg: &msgSkipf,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := CaptureSkip(t, tt.fn)
+			didGet, didWant := got != nil, tt.wantMsg != nil
+			if didGet != didWant {
+				t.Errorf("CaptureSkip got? %v, want? %v", didGet, didWant)
+			}
+			if didGet && didWant && *got != *tt.wantMsg {
+				t.Errorf("CaptureSkip got msg = %q, want %q", *got, *tt.wantMsg)
+			}
+		})
+	}
+}
+
+type adapterSkip struct {
+	reason string
+}
+
+func TestRegisterSkipClassifier(t *testing.T) {
+	unregister := RegisterSkipClassifier(func(r interface{}) (string, bool) {
+		if s, ok := r.(adapterSkip); ok {
+			return s.reason, true
+		}
+		return "", false
+	})
+	t.Cleanup(unregister)
+
+	want := "no hardware"
+	got := CaptureSkip(t, func(testing.TB) {
+		panic(adapterSkip{reason: want})
+	})
+	if got == nil || *got != want {
+		t.Errorf("CaptureSkip got msg = %v, want %q", got, want)
+	}
+
+	var gotPanic interface{}
+	func() {
+		defer func() {
+			gotPanic = recover()
+		}()
+		CaptureSkip(t, func(testing.TB) {
+			panic("my panic")
+		})
+	}()
+	if gotPanic != "my panic" {
+		t.Errorf("Panic arg = %q, want %q", gotPanic, "my panic")
+	}
+}
+
+func TestUnregisterSkipClassifier(t *testing.T) {
+	unregister := RegisterSkipClassifier(func(r interface{}) (string, bool) {
+		s, ok := r.(adapterSkip)
+		return s.reason, ok
+	})
+	unregister()
+	unregister() // A second call has no effect.
+
+	got := CapturePanic(t, func(t testing.TB) {
+		CaptureSkip(t, func(testing.TB) {
+			panic(adapterSkip{reason: "no hardware"})
+		})
+	})
+	if want := (adapterSkip{reason: "no hardware"}); got != want {
+		t.Errorf("CaptureSkip after unregistering panicked with %v, want %v", got, want)
+	}
+}
+
+func TestCaptureReentrant(t *testing.T) {
+	var afterFatal bool
+	walk := func(t testing.TB, visit func()) {
+		t.Error("walking")
+		visit()
+		afterFatal = true
+	}
+	msg, errs := CaptureReentrant(t, func(t testing.TB) {
+		walk(t, func() {
+			t.Errorf("visiting")
+			walk(t, func() {
+				t.Fatalf("nested visit failed")
+			})
+		})
+	})
+	if want := "nested visit failed"; msg == nil || *msg != want {
+		t.Errorf("CaptureReentrant got msg = %v, want %q", msg, want)
+	}
+	if want := []string{"walking\n", "visiting", "walking\n"}; !cmp.Equal(errs, want) {
+		t.Errorf("CaptureReentrant got errs = %q, want %q", errs, want)
+	}
+	if afterFatal {
+		t.Errorf("CaptureReentrant continued running the function after a nested fatal")
+	}
+}
+
+func TestCaptureWithSeed(t *testing.T) {
+	pick := func(t testing.TB, rng *rand.Rand) {
+		for i := 0; i < 3; i++ {
+			t.Errorf("picked %d", rng.Intn(1000))
+		}
+		t.Fatalf("giving up after %d", rng.Intn(1000))
+	}
+	msg, errs := CaptureWithSeed(t, 42, pick)
+	if msg == nil || len(errs) != 3 {
+		t.Fatalf("CaptureWithSeed got fatal %v and errors %q, want a fatal and 3 errors", msg, errs)
+	}
+	msg2, errs2 := CaptureWithSeed(t, 42, pick)
+	if *msg != *msg2 || !cmp.Equal(errs, errs2) {
+		t.Errorf("CaptureWithSeed got fatal %q and errors %q on second run, want %q and %q", *msg2, errs2, *msg, errs)
+	}
+}
+
+func TestExpectSeedReproducible(t *testing.T) {
+	t.Run("deterministic", func(t *testing.T) {
+		ExpectSeedReproducible(t, 1, func(t testing.TB, rng *rand.Rand) {
+			t.Errorf("picked %d", rng.Intn(1000))
+		})
+	})
+
+	t.Run("nondeterministic", func(t *testing.T) {
+		var runs int
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectSeedReproducible(t, 1, func(t testing.TB, rng *rand.Rand) {
+				runs++
+				t.Errorf("run %d picked %d", runs, rng.Intn(1000))
+			})
+		})
+		if want := "not reproducible"; !strings.Contains(got, want) {
+			t.Errorf("ExpectSeedReproducible got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectFatalNoInternalTypes(t *testing.T) {
+	t.Run("clean", func(t *testing.T) {
+		want := "invalid config: missing name"
+		if got := ExpectFatalNoInternalTypes(t, "testt", func(t testing.TB) { t.Fatal("invalid config: missing name") }); got != want+"\n" {
+			t.Errorf("ExpectFatalNoInternalTypes got msg = %q, want %q", got, want+"\n")
+		}
+	})
+
+	t.Run("exported type", func(t *testing.T) {
+		ExpectFatalNoInternalTypes(t, "testt", func(t testing.TB) { t.Fatalf("unexpected testt.Config") })
+	})
+
+	t.Run("leaks internal type", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalNoInternalTypes(t, "testt", func(t testing.TB) { t.Fatalf("unexpected value of type %T", t) })
+		})
+		if want := "references internal type testt.fakeT"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalNoInternalTypes got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectFailNowOnFirst(t *testing.T) {
+	t.Run("stops at first failure", func(t *testing.T) {
+		got := ExpectFailNowOnFirst(t, func(t testing.TB) {
+			t.Fatal("first check failed")
+			t.Error("second check failed")
+		})
+		if want := "first check failed\n"; got != want {
+			t.Errorf("ExpectFailNowOnFirst got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("keeps reporting", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFailNowOnFirst(t, func(t testing.TB) {
+				var wg sync.WaitGroup
+				done := make(chan struct{})
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-done
+					t.Error("second check failed")
+				}()
+				defer wg.Wait()
+				defer close(done)
+				t.FailNow()
+			})
+		})
+		if want := `raised error "second check failed\n" after failing fatally`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFailNowOnFirst got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureMaxDepth(t *testing.T) {
+	type node struct {
+		children []*node
+	}
+	tree := &node{children: []*node{
+		{},
+		{children: []*node{{children: []*node{{}}}}},
+	}}
+
+	tests := []struct {
+		desc      string
+		limit     int
+		wantDepth int
+		wantFatal bool
+	}{{
+		desc:      "within limit",
+		limit:     5,
+		wantDepth: 3,
+	}, {
+		desc:      "exceeds limit",
+		limit:     2,
+		wantDepth: 3,
+		wantFatal: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			gotDepth, gotMsg := CaptureMaxDepth(t, func(t testing.TB, recurse func(func()), depth func() int) {
+				var walk func(n *node)
+				walk = func(n *node) {
+					if depth() > tt.limit {
+						t.Fatalf("tree deeper than %d", tt.limit)
+					}
+					for _, c := range n.children {
+						recurse(func() { walk(c) })
+					}
+				}
+				walk(tree)
+			})
+			if gotDepth != tt.wantDepth {
+				t.Errorf("CaptureMaxDepth got depth %d, want %d", gotDepth, tt.wantDepth)
+			}
+			if gotFatal := gotMsg != nil; gotFatal != tt.wantFatal {
+				t.Errorf("CaptureMaxDepth got fatal? %v, want? %v", gotFatal, tt.wantFatal)
+			}
+		})
+	}
+}
+
+func TestCaptureErrorSeverities(t *testing.T) {
+	got := CaptureErrorSeverities(t, func(t testing.TB) {
+		t.Errorf("WARN: disk nearly full")
+		t.Errorf("ERROR: disk full")
+		t.Error("WARN: fan slow")
+		t.Errorf("no severity")
+		t.Errorf("severity: ERROR")
+	})
+	want := map[string]int{"WARN": 2, "ERROR": 1, "": 1, "severity": 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CaptureErrorSeverities got unexpected counts (-want +got):\n%s", diff)
+	}
+}
+
+func TestExpectNoSeverity(t *testing.T) {
+	fn := func(t testing.TB) {
+		t.Errorf("WARN: disk nearly full")
+		t.Errorf("ERROR: disk full")
+	}
+	ExpectNoSeverity(t, "FATAL", fn)
+	got := ExpectFatal(t, func(t testing.TB) { ExpectNoSeverity(t, "ERROR", fn) })
+	if want := `raised 1 errors with severity "ERROR"`; !strings.Contains(got, want) {
+		t.Errorf("ExpectNoSeverity got msg = %q, want substring %q", got, want)
+	}
+}
+
+func TestCaptureIterationsToFatal(t *testing.T) {
+	pollUntil := func(limit int) func(testing.TB, func()) {
+		return func(t testing.TB, tick func()) {
+			for i := 0; i < 10; i++ {
+				tick()
+				if i+1 == limit {
+					t.Fatalf("condition not met after %d polls", limit)
+				}
+			}
+		}
+	}
+	if got, want := CaptureIterationsToFatal(t, pollUntil(3)), 3; got != want {
+		t.Errorf("CaptureIterationsToFatal got %d, want %d", got, want)
+	}
+	if got, want := CaptureIterationsToFatal(t, pollUntil(20)), -1; got != want {
+		t.Errorf("CaptureIterationsToFatal got %d, want %d", got, want)
+	}
+}
+
+func TestExpectFatalWithinIterations(t *testing.T) {
+	fatalAfter := func(n int) func(testing.TB, func()) {
+		return func(t testing.TB, tick func()) {
+			for i := 0; i < n; i++ {
+				tick()
+			}
+			t.Fatal("timed out")
+		}
+	}
+
+	if got, want := ExpectFatalWithinIterations(t, 5, fatalAfter(4)), 4; got != want {
+		t.Errorf("ExpectFatalWithinIterations got %d, want %d", got, want)
+	}
+	got := ExpectFatal(t, func(t testing.TB) { ExpectFatalWithinIterations(t, 5, fatalAfter(6)) })
+	if want := "after 6 iterations, want at most 5"; !strings.Contains(got, want) {
+		t.Errorf("ExpectFatalWithinIterations got msg = %q, want substring %q", got, want)
+	}
+}
+
+type eventLog []string
+
+func (l *eventLog) Record(event string) {
+	*l = append(*l, event)
+}
+
+func TestCaptureWithObserver(t *testing.T) {
+	var events eventLog
+	msg := CaptureWithObserver(t, &events, func(t testing.TB, obs Observer) {
+		obs.Record("GET /config")
+		obs.Record("PUT /config")
+		t.Fatalf("PUT /config returned 503")
+	})
+	if want := "PUT /config returned 503"; msg == nil || *msg != want {
+		t.Errorf("CaptureWithObserver got msg = %v, want %q", msg, want)
+	}
+	if want := (eventLog{"GET /config", "PUT /config"}); !cmp.Equal(events, want) {
+		t.Errorf("CaptureWithObserver recorded events %q, want %q", events, want)
+	}
+}
+
+func TestExpectUniqueErrors(t *testing.T) {
+	fn := func(t testing.TB) {
+		for _, name := range []string{"eth0", "eth1", "eth0"} {
+			t.Errorf("interface %s down", name)
+		}
+		t.Errorf("interface eth1 down")
+	}
+
+	t.Run("duplicates collapse", func(t *testing.T) {
+		ExpectUniqueErrors(t, []string{"interface eth1 down", "interface eth0 down"}, fn)
+	})
+
+	t.Run("unexpected extra", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectUniqueErrors(t, []string{"interface eth0 down"}, fn)
+		})
+		if want := "interface eth1 down"; !strings.Contains(got, want) {
+			t.Errorf("ExpectUniqueErrors got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCleanup(t *testing.T) {
+	var got []string
+	msg := CaptureFatal(t, func(t testing.TB) {
+		t.Cleanup(func() { got = append(got, "first") })
+		t.Cleanup(func() { got = append(got, "second") })
+		t.FailNow()
+	})
+	if msg == nil {
+		t.Errorf("CaptureFatal got no fatal, want one")
+	}
+	if want := []string{"second", "first"}; !cmp.Equal(got, want) {
+		t.Errorf("CaptureFatal ran cleanups %q, want %q", got, want)
+	}
+}
+
+func TestCleanupFatal(t *testing.T) {
+	t.Run("only in cleanup", func(t *testing.T) {
+		var ranFirst bool
+		msg := CaptureFatal(t, func(t testing.TB) {
+			t.Cleanup(func() { ranFirst = true })
+			t.Cleanup(func() { t.Fatalf("closing session: %v", io.ErrClosedPipe) })
+		})
+		if want := "closing session: io: read/write on closed pipe"; msg == nil || *msg != want {
+			t.Errorf("CaptureFatal got msg = %v, want %q", fmtMsg(msg), want)
+		}
+		if !ranFirst {
+			t.Errorf("CaptureFatal did not run the cleanup registered before the fatal one")
+		}
+	})
+
+	t.Run("after fatal", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			t.Cleanup(func() { t.Fatalf("closing session") })
+			t.Fatalf("dut1 unreachable")
+		})
+		if want := "dut1 unreachable"; got != want {
+			t.Errorf("ExpectFatal got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("in ExpectError", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectError(t, func(t testing.TB) {
+				t.Cleanup(func() { t.Fatalf("closing session") })
+				t.Errorf("dut1 unreachable")
+			})
+		})
+		if want := "registered a cleanup that failed fatally: closing session"; !strings.Contains(got, want) {
+			t.Errorf("ExpectError got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectNoLeftoverTempDirs(t *testing.T) {
+	t.Run("removed", func(t *testing.T) {
+		var dir string
+		ExpectNoLeftoverTempDirs(t, func(t testing.TB) {
+			dir = t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte("{}"), 0o600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+		})
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("TempDir %s still exists after cleanup: %v", dir, err)
+		}
+	})
+
+	t.Run("recreated", func(t *testing.T) {
+		var dir string
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectNoLeftoverTempDirs(t, func(t testing.TB) {
+				t.Cleanup(func() { os.Mkdir(dir, 0o700) })
+				dir = t.TempDir()
+			})
+		})
+		defer os.RemoveAll(dir)
+		if want := "left temporary directory " + dir; !strings.Contains(got, want) {
+			t.Errorf("ExpectNoLeftoverTempDirs got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectFatalSameGoroutine(t *testing.T) {
+	t.Run("same goroutine", func(t *testing.T) {
+		got := ExpectFatalSameGoroutine(t, func(t testing.TB) {
+			t.Fatalf("direct failure")
+		})
+		if want := "direct failure"; got != want {
+			t.Errorf("ExpectFatalSameGoroutine got msg = %q, want %q", got, want)
+		}
+	})
+
+	// A helper that fails fatally from a goroutine it spawned is stopped on
+	// that goroutine and reported, provided it waits for the goroutine.
+	t.Run("spawned goroutine", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalSameGoroutine(t, func(t testing.TB) {
+				var wg sync.WaitGroup
+				wg.Add(1)
+				// Call through a func value to placate vet, which rightly
+				// flags this pattern.
+				fatalf := t.Fatalf
+				go func() {
+					defer wg.Done()
+					fatalf("spawned failure")
+				}()
+				wg.Wait()
+			})
+		})
+		if want := "failed fatally from a spawned goroutine"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalSameGoroutine got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("no fatal", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalSameGoroutine(t, func(testing.TB) {})
+		})
+		if want := "did not fail fatally"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalSameGoroutine got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureFatalCtx(t *testing.T) {
+	t.Run("context expires", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		msg, err := CaptureFatalCtx(ctx, t, func(ctx context.Context, t testing.TB) {
+			<-ctx.Done()
+			t.Fatalf("gave up waiting: %v", ctx.Err())
+		})
+		if want := "gave up waiting: context deadline exceeded"; msg == nil || *msg != want {
+			t.Errorf("CaptureFatalCtx got msg = %v, want %q", fmtMsg(msg), want)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CaptureFatalCtx got err = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("function finishes first", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		msg, err := CaptureFatalCtx(ctx, t, func(ctx context.Context, t testing.TB) {})
+		if msg != nil || err != nil {
+			t.Errorf("CaptureFatalCtx got (%v, %v), want (<none>, nil)", fmtMsg(msg), err)
+		}
+	})
+}
+
+func TestExpectDistinctFatals(t *testing.T) {
+	t.Run("tailored", func(t *testing.T) {
+		gotA, gotB := ExpectDistinctFatals(t, "eth0", "eth1", func(t testing.TB, in string) {
+			t.Fatalf("interface %s not found", in)
+		})
+		if wantA, wantB := "interface eth0 not found", "interface eth1 not found"; gotA != wantA || gotB != wantB {
+			t.Errorf("ExpectDistinctFatals got (%q, %q), want (%q, %q)", gotA, gotB, wantA, wantB)
+		}
+	})
+
+	t.Run("generic", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectDistinctFatals(t, "eth0", "eth1", func(t testing.TB, in string) {
+				t.Fatal("interface not found")
+			})
+		})
+		if want := "same message"; !strings.Contains(got, want) {
+			t.Errorf("ExpectDistinctFatals got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectErrorsHaveKey(t *testing.T) {
+	t.Run("all have key", func(t *testing.T) {
+		got := ExpectErrorsHaveKey(t, "device", func(t testing.TB) {
+			t.Errorf("link down device=dut1 port=1")
+			t.Error("device=dut2 unreachable")
+		})
+		if want := []string{"link down device=dut1 port=1", "device=dut2 unreachable\n"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectErrorsHaveKey got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorsHaveKey(t, "device", func(t testing.TB) {
+				t.Errorf("link down device=dut1")
+				t.Errorf("link down port=1 mydevice=dut2")
+			})
+		})
+		if want := `raised error "link down port=1 mydevice=dut2" without key "device"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorsHaveKey got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectFatalOnNil(t *testing.T) {
+	t.Run("mentions nil", func(t *testing.T) {
+		if got, want := ExpectFatalOnNil(t, func(t testing.TB) { t.Fatal("config is nil") }), "config is nil\n"; got != want {
+			t.Errorf("ExpectFatalOnNil got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("generic message", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalOnNil(t, func(t testing.TB) { t.Fatal("bad config") })
+		})
+		if want := `does not mention "nil"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalOnNil got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("custom substring", func(t *testing.T) {
+		ExpectFatalOnNilMentioning(t, "missing", func(t testing.TB) { t.Fatal("config missing") })
+	})
+}
+
+func TestRetrySkip(t *testing.T) {
+	skipFirst := func(n int, calls *int) func(testing.TB) {
+		return func(t testing.TB) {
+			*calls++
+			if *calls <= n {
+				t.Skipf("resource busy (attempt %d)", *calls)
+			}
+		}
+	}
+
+	t.Run("recovers", func(t *testing.T) {
+		var calls int
+		if got := RetrySkip(t, 5, time.Millisecond, skipFirst(2, &calls)); got != nil {
+			t.Errorf("RetrySkip got msg = %q, want nil", *got)
+		}
+		if calls != 3 {
+			t.Errorf("RetrySkip made %d calls, want 3", calls)
+		}
+	})
+
+	t.Run("always skips", func(t *testing.T) {
+		var calls int
+		got := RetrySkip(t, 3, time.Millisecond, skipFirst(10, &calls))
+		if want := "resource busy (attempt 3)"; got == nil || *got != want {
+			t.Errorf("RetrySkip got msg = %v, want %q", fmtMsg(got), want)
+		}
+	})
+
+	t.Run("no attempts", func(t *testing.T) {
+		var calls int
+		got := ExpectFatal(t, func(t testing.TB) {
+			RetrySkip(t, 0, time.Millisecond, skipFirst(10, &calls))
+		})
+		if want := "got 0 attempts, want at least 1"; !strings.Contains(got, want) {
+			t.Errorf("RetrySkip got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectNoRedundantErrors(t *testing.T) {
+	tests := []struct {
+		desc     string
+		errs     []string
+		wantFail bool
+	}{{
+		desc: "distinct",
+		errs: []string{"port 1 down", "port 2 flapping"},
+	}, {
+		desc:     "general and specific",
+		errs:     []string{"port 1 down", "port 1 down: no light detected"},
+		wantFail: true,
+	}, {
+		desc:     "repeated",
+		errs:     []string{"port 1 down", "port 1 down"},
+		wantFail: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fn := func(t testing.TB) {
+				for _, err := range tt.errs {
+					t.Errorf("%s", err)
+				}
+			}
+			if !tt.wantFail {
+				if got := ExpectNoRedundantErrors(t, fn); !cmp.Equal(got, tt.errs) {
+					t.Errorf("ExpectNoRedundantErrors got %q, want %q", got, tt.errs)
+				}
+				return
+			}
+			got := ExpectFatal(t, func(t testing.TB) { ExpectNoRedundantErrors(t, fn) })
+			if want := "redundant errors"; !strings.Contains(got, want) {
+				t.Errorf("ExpectNoRedundantErrors got msg = %q, want substring %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCaptureErrorCountOverRuns(t *testing.T) {
+	var runs int
+	got := CaptureErrorCountOverRuns(t, 3, func(t testing.TB) {
+		runs++
+		for i := 0; i < runs; i++ {
+			t.Errorf("error %d", i)
+		}
+	})
+	if want := []int{1, 2, 3}; !cmp.Equal(got, want) {
+		t.Errorf("CaptureErrorCountOverRuns got %v, want %v", got, want)
+	}
+}
+
+func TestExpectStableErrorCount(t *testing.T) {
+	t.Run("stable", func(t *testing.T) {
+		got := ExpectStableErrorCount(t, 3, func(t testing.TB) {
+			t.Error("first")
+			t.Error("second")
+		})
+		if want := 2; got != want {
+			t.Errorf("ExpectStableErrorCount got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("flaky", func(t *testing.T) {
+		var runs int
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectStableErrorCount(t, 3, func(t testing.TB) {
+				runs++
+				if runs%2 == 0 {
+					t.Error("intermittent")
+				}
+			})
+		})
+		if want := "varying number of errors over 3 runs: [0 1 0]"; !strings.Contains(got, want) {
+			t.Errorf("ExpectStableErrorCount got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	for _, runs := range []int{0, -1} {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectStableErrorCount(t, runs, func(t testing.TB) { t.Error("first") })
+		})
+		if want := fmt.Sprintf("got %d runs, want at least 1", runs); !strings.Contains(got, want) {
+			t.Errorf("ExpectStableErrorCount got msg = %q, want substring %q", got, want)
+		}
+	}
+}
+
+func TestCaptureDrains(t *testing.T) {
+	t.Run("drains fully", func(t *testing.T) {
+		var sum int
+		msg := CaptureDrains(t, []int{1, 2, 3}, func(t testing.TB, ch <-chan int) {
+			for v := range ch {
+				sum += v
+			}
+		})
+		if msg != nil || sum != 6 {
+			t.Errorf("CaptureDrains got (%v, sum %d), want (<none>, sum 6)", fmtMsg(msg), sum)
+		}
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		msg := CaptureDrains(t, []string{"a", "b"}, func(t testing.TB, ch <-chan string) {
+			t.Fatalf("unexpected item %q", <-ch)
+		})
+		if want := `unexpected item "a"`; msg == nil || *msg != want {
+			t.Errorf("CaptureDrains got msg = %v, want %q", fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("leaves items", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureDrains(t, []string{"a", "b", "c"}, func(t testing.TB, ch <-chan string) {
+				<-ch
+			})
+		})
+		if want := "without consuming 2 of 3 items"; !strings.Contains(got, want) {
+			t.Errorf("CaptureDrains got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureReaderError(t *testing.T) {
+	readConfig := func(t testing.TB, r io.Reader) {
+		if _, err := io.ReadAll(r); err != nil {
+			t.Fatalf("reading config: %v", err)
+		}
+	}
+
+	if msg := CaptureReaderError(t, strings.NewReader("{}"), readConfig); msg != nil {
+		t.Errorf("CaptureReaderError got msg = %q, want nil", *msg)
+	}
+	msg := CaptureReaderError(t, iotest.ErrReader(errors.New("connection reset")), readConfig)
+	if want := "reading config: connection reset"; msg == nil || *msg != want {
+		t.Errorf("CaptureReaderError got msg = %v, want %q", fmtMsg(msg), want)
+	}
+}
+
+func TestExpectFatalAnyOf(t *testing.T) {
+	patterns := []*regexp.Regexp{
+		regexp.MustCompile(`^timed out`),
+		regexp.MustCompile(`connection (refused|reset)`),
+	}
+
+	t.Run("matches second", func(t *testing.T) {
+		gotIdx, gotMsg := ExpectFatalAnyOf(t, patterns, func(t testing.TB) {
+			t.Fatalf("dial: connection refused")
+		})
+		if wantIdx, wantMsg := 1, "dial: connection refused"; gotIdx != wantIdx || gotMsg != wantMsg {
+			t.Errorf("ExpectFatalAnyOf got (%d, %q), want (%d, %q)", gotIdx, gotMsg, wantIdx, wantMsg)
+		}
+	})
+
+	t.Run("matches none", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalAnyOf(t, patterns, func(t testing.TB) { t.Fatalf("permission denied") })
+		})
+		if want := `"permission denied" matches none of`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalAnyOf got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectErrorPerInvalid(t *testing.T) {
+	ports := []int{80, -1, 70000}
+	invalid := func(p int) bool { return p < 0 || p > 65535 }
+
+	t.Run("one per invalid", func(t *testing.T) {
+		got := ExpectErrorPerInvalid(t, ports, invalid, func(t testing.TB, ports []int) {
+			for _, p := range ports {
+				if invalid(p) {
+					t.Errorf("port %d out of range", p)
+				}
+			}
+		})
+		if want := []string{"port -1 out of range", "port 70000 out of range"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectErrorPerInvalid got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("stops at first", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorPerInvalid(t, ports, invalid, func(t testing.TB, ports []int) {
+				for _, p := range ports {
+					if invalid(p) {
+						t.Errorf("port %d out of range", p)
+						return
+					}
+				}
+			})
+		})
+		if want := "raised 1 errors for 2 invalid items"; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorPerInvalid got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func checkName(t testing.TB, name string) {
+	t.Helper()
+	if name == "" {
+		t.Errorf("name is empty")
+	}
+}
+
+func checkConfig(t testing.TB, name string) {
+	t.Helper()
+	checkName(t, name)
+}
+
+func checkNameUnmarked(t testing.TB, name string) {
+	if name == "" {
+		t.Fatalf("name is empty")
+	}
+}
+
+func checkConfigUnmarkedCallee(t testing.TB, name string) {
+	t.Helper()
+	checkNameUnmarked(t, name)
+}
+
+func TestExpectHelperInAllFrames(t *testing.T) {
+	t.Run("all marked", func(t *testing.T) {
+		ExpectHelperInAllFrames(t, func(t testing.TB) {
+			checkConfig(t, "")
+		})
+	})
+
+	t.Run("direct report", func(t *testing.T) {
+		ExpectHelperInAllFrames(t, func(t testing.TB) {
+			t.Errorf("reported without a helper")
+		})
+	})
+
+	t.Run("nested unmarked", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectHelperInAllFrames(t, func(t testing.TB) {
+				checkConfigUnmarkedCallee(t, "")
+			})
+		})
+		if want := "checkNameUnmarked, which did not call t.Helper"; !strings.Contains(got, want) {
+			t.Errorf("ExpectHelperInAllFrames got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureWithFakeClock(t *testing.T) {
+	start := time.Now()
+	msg := CaptureWithFakeClock(t, func(t testing.TB, clock FakeClock) {
+		deadline := clock.Now().Add(time.Hour)
+		for i := 0; ; i++ {
+			if clock.Now().After(deadline) {
+				t.Fatalf("not converged after %d polls", i)
+			}
+			clock.Advance(10 * time.Minute)
+		}
+	})
+	if want := "not converged after 7 polls"; msg == nil || *msg != want {
+		t.Errorf("CaptureWithFakeClock got msg = %v, want %q", fmtMsg(msg), want)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("CaptureWithFakeClock took %v of real time", elapsed)
+	}
+}
+
+func TestExpectNoDuplicateLogs(t *testing.T) {
+	t.Run("unique", func(t *testing.T) {
+		got := ExpectNoDuplicateLogs(t, func(t testing.TB) {
+			for _, dev := range []string{"dut1", "dut2"} {
+				t.Logf("configuring %s", dev)
+			}
+		})
+		if want := []string{"configuring dut1", "configuring dut2"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectNoDuplicateLogs got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectNoDuplicateLogs(t, func(t testing.TB) {
+				for _, dev := range []string{"dut1", "dut2"} {
+					t.Log("configuring devices")
+					t.Logf("configuring %s", dev)
+				}
+			})
+		})
+		if want := `logged "configuring devices\n" more than once`; !strings.Contains(got, want) {
+			t.Errorf("ExpectNoDuplicateLogs got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectPromptReturn(t *testing.T) {
+	t.Run("responsive", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ExpectPromptReturn(ctx, cancel, time.Second, t, func(ctx context.Context, t testing.TB) {
+			<-ctx.Done()
+			t.Fatalf("cancelled: %v", ctx.Err())
+		})
+	})
+
+	t.Run("laggy", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectPromptReturn(ctx, cancel, 10*time.Millisecond, t, func(ctx context.Context, t testing.TB) {
+				time.Sleep(100 * time.Millisecond)
+			})
+		})
+		if want := "did not return within 10ms of context cancellation"; !strings.Contains(got, want) {
+			t.Errorf("ExpectPromptReturn got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		got := CapturePanic(t, func(t testing.TB) {
+			ExpectPromptReturn(ctx, cancel, time.Second, t, func(ctx context.Context, t testing.TB) {
+				<-ctx.Done()
+				panic("my panic")
+			})
+		})
+		if want := "my panic"; got != want {
+			t.Errorf("ExpectPromptReturn panicked with %v, want %q", got, want)
+		}
+	})
+}
+
+func TestExpectLogSeverityMonotonic(t *testing.T) {
+	order := []string{"INFO", "WARN", "ERROR"}
+	tests := []struct {
+		desc     string
+		logs     []string
+		wantFail bool
+	}{{
+		desc: "escalates",
+		logs: []string{"INFO: starting", "INFO: polling", "progress 50%", "WARN: slow", "ERROR: timed out"},
+	}, {
+		desc:     "de-escalates",
+		logs:     []string{"INFO: starting", "ERROR: timed out", "WARN: slow"},
+		wantFail: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fn := func(t testing.TB) {
+				for _, line := range tt.logs {
+					t.Logf("%s", line)
+				}
+			}
+			if !tt.wantFail {
+				ExpectLogSeverityMonotonic(t, order, fn)
+				return
+			}
+			got := ExpectFatal(t, func(t testing.TB) { ExpectLogSeverityMonotonic(t, order, fn) })
+			if want := `logged "WARN: slow" after "ERROR: timed out"`; !strings.Contains(got, want) {
+				t.Errorf("ExpectLogSeverityMonotonic got msg = %q, want substring %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCaptureWithWaitGroup(t *testing.T) {
+	t.Run("done", func(t *testing.T) {
+		msg, ok := CaptureWithWaitGroup(t, func(t testing.TB, wg *sync.WaitGroup) {
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go wg.Done()
+			}
+			t.Fatal("workers started")
+		})
+		if want := "workers started\n"; msg == nil || *msg != want || !ok {
+			t.Errorf("CaptureWithWaitGroup got (%v, %v), want (%q, true)", fmtMsg(msg), ok, want)
+		}
+	})
+
+	t.Run("leftover counter", func(t *testing.T) {
+		var wg *sync.WaitGroup
+		msg, ok := CaptureWithWaitGroup(t, func(t testing.TB, w *sync.WaitGroup) {
+			wg = w
+			wg.Add(2)
+			wg.Done()
+		})
+		defer wg.Done()
+		if msg != nil || ok {
+			t.Errorf("CaptureWithWaitGroup got (%v, %v), want (<none>, false)", fmtMsg(msg), ok)
+		}
+	})
+}
+
+func TestExpectErrorsSubsetOf(t *testing.T) {
+	allowed := []string{"missing name", "missing address"}
+
+	t.Run("in vocabulary", func(t *testing.T) {
+		got := ExpectErrorsSubsetOf(t, allowed, func(t testing.TB) {
+			t.Errorf("missing address")
+			t.Errorf("missing address")
+		})
+		if want := []string{"missing address", "missing address"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectErrorsSubsetOf got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("out of vocabulary", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorsSubsetOf(t, allowed, func(t testing.TB) {
+				t.Errorf("missing name")
+				t.Error("missing name")
+			})
+		})
+		if want := `raised error "missing name\n", which is not one of`; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorsSubsetOf got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCapturePanic(t *testing.T) {
+	if got := CapturePanic(t, func(testing.TB) {}); got != nil {
+		t.Errorf("CapturePanic got %v, want nil", got)
+	}
+	if got := CapturePanic(t, func(t testing.TB) { t.Fatal("fatal") }); got != nil {
+		t.Errorf("CapturePanic got %v for a fatal failure, want nil", got)
+	}
+	if got, want := CapturePanic(t, func(testing.TB) { panic("my panic") }), "my panic"; got != want {
+		t.Errorf("CapturePanic got %v, want %q", got, want)
+	}
+}
+
+func TestExpectConcurrentPanicFree(t *testing.T) {
+	const n = 4
+
+	t.Run("panic free", func(t *testing.T) {
+		var mu sync.Mutex
+		var calls int
+		ExpectConcurrentPanicFree(t, n, func(t testing.TB) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+		})
+		if calls != n {
+			t.Errorf("ExpectConcurrentPanicFree made %d calls, want %d", calls, n)
+		}
+	})
+
+	t.Run("concurrently panicking", func(t *testing.T) {
+		var inUse int32
+		var arrived sync.WaitGroup
+		arrived.Add(n)
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectConcurrentPanicFree(t, n, func(t testing.TB) {
+				atomic.AddInt32(&inUse, 1)
+				arrived.Done()
+				arrived.Wait()
+				if atomic.LoadInt32(&inUse) > 1 {
+					panic("concurrent use")
+				}
+			})
+		})
+		if want := "panicked in 4 of 4 concurrent calls: [concurrent use"; !strings.Contains(got, want) {
+			t.Errorf("ExpectConcurrentPanicFree got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+// runWide runs width units of work concurrently, each bracketed by enter and
+// leave, and waits for them all to have entered before any leaves.
+func runWide(width int, enter, leave func()) {
+	var entered, done sync.WaitGroup
+	entered.Add(width)
+	done.Add(width)
+	for i := 0; i < width; i++ {
+		go func() {
+			defer done.Done()
+			enter()
+			entered.Done()
+			entered.Wait()
+			leave()
+		}()
+	}
+	done.Wait()
+}
+
+func TestCaptureObserveParallelism(t *testing.T) {
+	tests := []struct {
+		desc     string
+		hint     int
+		width    int
+		wantPeak int
+	}{{
+		desc:     "respects hint",
+		hint:     4,
+		width:    4,
+		wantPeak: 4,
+	}, {
+		desc:     "exceeds hint",
+		hint:     2,
+		width:    4,
+		wantPeak: 4,
+	}, {
+		desc:     "sequential",
+		hint:     1,
+		width:    1,
+		wantPeak: 1,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := CaptureObserveParallelism(t, func(t testing.TB, enter, leave func()) {
+				runWide(tt.width, enter, leave)
+			})
+			if got != tt.wantPeak {
+				t.Errorf("CaptureObserveParallelism got peak %d, want %d", got, tt.wantPeak)
+			}
+			if exceeded, wantExceeded := got > tt.hint, tt.width > tt.hint; exceeded != wantExceeded {
+				t.Errorf("CaptureObserveParallelism got peak %d exceeding hint %d? %v, want? %v", got, tt.hint, exceeded, wantExceeded)
+			}
+		})
+	}
+}
+
+func TestExpectLoggerSilent(t *testing.T) {
+	t.Run("silent", func(t *testing.T) {
+		if msg := ExpectLoggerSilent(t, func(t testing.TB, l *log.Logger) {}); msg != nil {
+			t.Errorf("ExpectLoggerSilent got msg = %q, want nil", *msg)
+		}
+	})
+
+	t.Run("chatty", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectLoggerSilent(t, func(t testing.TB, l *log.Logger) {
+				l.Printf("connecting to %s", "dut1")
+			})
+		})
+		if want := "wrote to its logger:\nconnecting to dut1"; !strings.Contains(got, want) {
+			t.Errorf("ExpectLoggerSilent got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+type fakeStore struct {
+	keys []string
+}
+
+func TestExpectFatalDeterministicWithDeps(t *testing.T) {
+	makeStore := func() *fakeStore { return &fakeStore{keys: []string{"a", "b"}} }
+
+	t.Run("deterministic", func(t *testing.T) {
+		got := ExpectFatalDeterministicWithDeps(t, makeStore, 3, func(t testing.TB, s *fakeStore) {
+			s.keys = append(s.keys, "c")
+			t.Fatalf("store has %d keys", len(s.keys))
+		})
+		if want := "store has 3 keys"; got != want {
+			t.Errorf("ExpectFatalDeterministicWithDeps got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("helper varies", func(t *testing.T) {
+		var calls int
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalDeterministicWithDeps(t, makeStore, 3, func(t testing.TB, s *fakeStore) {
+				calls++
+				t.Fatalf("store has %d keys after %d calls", len(s.keys), calls)
+			})
+		})
+		if want := `"store has 2 keys after 2 calls" in run 2`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalDeterministicWithDeps got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("no runs", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalDeterministicWithDeps(t, makeStore, 0, func(t testing.TB, s *fakeStore) {
+				t.Fatalf("store has %d keys", len(s.keys))
+			})
+		})
+		if want := "got 0 runs, want at least 1"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalDeterministicWithDeps got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+type ctxKey string
+
+func TestCaptureCtxValues(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ctxKey("target"), "dut1")
+	ctx = context.WithValue(ctx, ctxKey("user"), "admin")
+	keys := []interface{}{ctxKey("target"), ctxKey("user")}
+
+	t.Run("reads keys", func(t *testing.T) {
+		msg := CaptureCtxValues(ctx, keys, t, func(ctx context.Context, t testing.TB) {
+			t.Fatalf("cannot log in to %v as %v", ctx.Value(ctxKey("target")), ctx.Value(ctxKey("user")))
+		})
+		if want := "cannot log in to dut1 as admin"; msg == nil || *msg != want {
+			t.Errorf("CaptureCtxValues got msg = %v, want %q", fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("ignores keys", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureCtxValues(ctx, keys, t, func(ctx context.Context, t testing.TB) {
+				ctx.Value(ctxKey("target"))
+			})
+		})
+		if want := "did not read context value user"; !strings.Contains(got, want) {
+			t.Errorf("CaptureCtxValues got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectHelperNoSideEffect(t *testing.T) {
+	ExpectHelperNoSideEffect(t, func(t testing.TB) {
+		checkConfig(t, "")
+		checkConfigUnmarkedCallee(t, "")
+	})
+}
+
+func TestCaptureErrorProgress(t *testing.T) {
+	const total = 4
+	got, msg := CaptureErrorProgress(t, func(t testing.TB, report func(i, total int)) {
+		for i := 0; i <= total; i++ {
+			report(i, total)
+		}
+		t.Fatalf("%d checks failed", 2)
+	})
+	if want := "2 checks failed"; msg == nil || *msg != want {
+		t.Errorf("CaptureErrorProgress got msg = %v, want %q", fmtMsg(msg), want)
+	}
+	for i, p := range got {
+		if p.I != i || p.Total != total {
+			t.Errorf("CaptureErrorProgress got report %d = %+v, want {I:%d Total:%d}", i, p, i, total)
+		}
+	}
+	if len(got) == 0 || got[len(got)-1].I != total {
+		t.Errorf("CaptureErrorProgress got reports %+v, want them to reach %d", got, total)
+	}
+}
+
+func TestFakeID(t *testing.T) {
+	if _, ok := FakeID(t); ok {
+		t.Errorf("FakeID(%T) got ok, want !ok", t)
+	}
+
+	const n = 8
+	var mu sync.Mutex
+	ids := make(map[uint64]int)
+	fns := make([]func(testing.TB), n)
+	for i := range fns {
+		fns[i] = func(t testing.TB) {
+			id, ok := FakeID(t)
+			if !ok {
+				t.Fatalf("FakeID(%T) got !ok, want ok", t)
+			}
+			if again, _ := FakeID(t); again != id {
+				t.Fatalf("FakeID got %d then %d, want a stable id", id, again)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			ids[id]++
+		}
+	}
+	ParallelFatal(t, fns...)
+	if len(ids) != n {
+		t.Errorf("ParallelFatal functions saw ids %v, want %d distinct ids", ids, n)
+	}
+}
+
+func TestExpectDefersRun(t *testing.T) {
+	t.Run("deferred on fatal path", func(t *testing.T) {
+		msg := ExpectDefersRun(t, func(t testing.TB, ran func()) {
+			defer ran()
+			t.Fatal("setup failed")
+		})
+		if want := "setup failed\n"; msg == nil || *msg != want {
+			t.Errorf("ExpectDefersRun got msg = %v, want %q", fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("not deferred", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectDefersRun(t, func(t testing.TB, ran func()) {
+				t.Fatal("setup failed")
+				ran()
+			})
+		})
+		if want := "without running its deferred function"; !strings.Contains(got, want) {
+			t.Errorf("ExpectDefersRun got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectErrorsReferenceOnly(t *testing.T) {
+	names := []string{"eth0", "eth1"}
+
+	t.Run("valid references", func(t *testing.T) {
+		got := ExpectErrorsReferenceOnly(t, names, func(t testing.TB) {
+			t.Errorf("interface %q down", "eth0")
+			t.Errorf("interface %q and %q have the same MTU of %d", "eth0", "eth1", 9000)
+		})
+		if len(got) != 2 {
+			t.Errorf("ExpectErrorsReferenceOnly got %q, want 2 errors", got)
+		}
+	})
+
+	t.Run("stale reference", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorsReferenceOnly(t, names, func(t testing.TB) {
+				t.Errorf("interface %q down", "eth2")
+			})
+		})
+		if want := `unknown entity "eth2"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorsReferenceOnly got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureWithResponses(t *testing.T) {
+	type status struct {
+		code int
+		msg  string
+	}
+	responses := []status{{code: 0}, {code: 14, msg: "unavailable"}, {code: 0}}
+
+	t.Run("fatal on response", func(t *testing.T) {
+		calls, msg := CaptureWithResponses(t, responses, func(t testing.TB, call func(string) status) {
+			for _, req := range []string{"get", "set", "get"} {
+				if resp := call(req); resp.code != 0 {
+					t.Fatalf("%s failed: %s", req, resp.msg)
+				}
+			}
+		})
+		if want := "set failed: unavailable"; calls != 2 || msg == nil || *msg != want {
+			t.Errorf("CaptureWithResponses got (%d, %v), want (2, %q)", calls, fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("too many calls", func(t *testing.T) {
+		calls, msg := CaptureWithResponses(t, responses, func(t testing.TB, call func(string) status) {
+			for {
+				call("poll")
+			}
+		})
+		if want := "unexpected call 4 with request poll: only 3 responses provided"; calls != 3 || msg == nil || *msg != want {
+			t.Errorf("CaptureWithResponses got (%d, %v), want (3, %q)", calls, fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("concurrent calls", func(t *testing.T) {
+		var mu sync.Mutex
+		var got []status
+		calls, msg := CaptureWithResponses(t, responses, func(t testing.TB, call func(string) status) {
+			var wg sync.WaitGroup
+			for i := 0; i < len(responses); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp := call("get")
+					mu.Lock()
+					defer mu.Unlock()
+					got = append(got, resp)
+				}()
+			}
+			wg.Wait()
+		})
+		if calls != 3 || msg != nil {
+			t.Errorf("CaptureWithResponses got (%d, %v), want (3, <none>)", calls, fmtMsg(msg))
+		}
+		less := func(a, b status) bool { return a.code < b.code }
+		if diff := cmp.Diff(responses, got, cmp.AllowUnexported(status{}), cmpopts.SortSlices(less)); diff != "" {
+			t.Errorf("CaptureWithResponses gave responses diff (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestCaptureWithValue(t *testing.T) {
+	msg := CaptureWithValue(t, 42, func(t testing.TB, v interface{}) {
+		if n := v.(int); n > 10 {
+			t.Fatalf("value %d too large", n)
+		}
+	})
+	if want := "value 42 too large"; msg == nil || *msg != want {
+		t.Errorf("CaptureWithValue got msg = %v, want %q", fmtMsg(msg), want)
+	}
+}
+
+func TestExpectFatalOnTypeMismatch(t *testing.T) {
+	t.Run("type in message", func(t *testing.T) {
+		got := ExpectFatalOnTypeMismatch(t, "42", func(t testing.TB, v interface{}) {
+			if _, ok := v.(int); !ok {
+				t.Fatalf("got value of type %T, want int", v)
+			}
+		})
+		if want := "got value of type string, want int"; got != want {
+			t.Errorf("ExpectFatalOnTypeMismatch got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("generic message", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalOnTypeMismatch(t, "42", func(t testing.TB, v interface{}) {
+				if _, ok := v.(int); !ok {
+					t.Fatal("bad value")
+				}
+			})
+		})
+		if want := "does not mention the type string"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalOnTypeMismatch got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureWithMarkers(t *testing.T) {
+	validate := func(t testing.TB, mark func(string), cfg map[string]string) {
+		if _, ok := cfg["name"]; !ok {
+			mark("default name")
+		}
+		if addr, ok := cfg["address"]; !ok || addr == "" {
+			mark("missing address")
+			t.Fatal("address is required")
+		}
+		mark("valid")
+	}
+
+	labels, msg := CaptureWithMarkers(t, func(t testing.TB, mark func(string)) {
+		validate(t, mark, map[string]string{"address": ""})
+	})
+	if want := []string{"default name", "missing address"}; !cmp.Equal(labels, want) {
+		t.Errorf("CaptureWithMarkers got labels %q, want %q", labels, want)
+	}
+	if want := "address is required\n"; msg == nil || *msg != want {
+		t.Errorf("CaptureWithMarkers got msg = %v, want %q", fmtMsg(msg), want)
+	}
+}
+
+func TestExpectSummaryError(t *testing.T) {
+	summary := regexp.MustCompile(`^\d+ checks failed$`)
+	tests := []struct {
+		desc      string
+		errs      []string
+		wantFatal string
+	}{{
+		desc: "trailing summary",
+		errs: []string{"eth0 down", "eth1 down", "2 checks failed"},
+	}, {
+		desc:      "no summary",
+		errs:      []string{"eth0 down", "eth1 down"},
+		wantFatal: `raised last error "eth1 down", want a summary`,
+	}, {
+		desc:      "summary first",
+		errs:      []string{"1 checks failed", "eth0 down", "1 checks failed"},
+		wantFatal: `raised summary error "1 checks failed" before its last error`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fn := func(t testing.TB) {
+				for _, err := range tt.errs {
+					t.Errorf("%s", err)
+				}
+			}
+			if tt.wantFatal == "" {
+				if got := ExpectSummaryError(t, summary, fn); !cmp.Equal(got, tt.errs) {
+					t.Errorf("ExpectSummaryError got %q, want %q", got, tt.errs)
+				}
+				return
+			}
+			if got := ExpectFatal(t, func(t testing.TB) { ExpectSummaryError(t, summary, fn) }); !strings.Contains(got, tt.wantFatal) {
+				t.Errorf("ExpectSummaryError got msg = %q, want substring %q", got, tt.wantFatal)
+			}
+		})
+	}
+
+	t.Run("no errors on non-aborting TB", func(t *testing.T) {
+		tt := &testT{}
+		if got := ExpectSummaryError(tt, summary, func(testing.TB) {}); len(got) != 0 {
+			t.Errorf("ExpectSummaryError got %q, want no errors", got)
+		}
+		if want := "did not raise an error"; !strings.Contains(tt.got, want) {
+			t.Errorf("ExpectSummaryError reported %q, want substring %q", tt.got, want)
+		}
+	})
+}
+
+func TestCaptureResourceBalance(t *testing.T) {
+	t.Run("leaks one", func(t *testing.T) {
+		n, msg := CaptureResourceBalance(t, func(t testing.TB, open func() func()) {
+			closeA := open()
+			defer closeA()
+			open()
+			t.Fatal("session failed")
+		})
+		if want := "session failed\n"; n != 1 || msg == nil || *msg != want {
+			t.Errorf("CaptureResourceBalance got (%d, %v), want (1, %q)", n, fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("closes all", func(t *testing.T) {
+		n, msg := CaptureResourceBalance(t, func(t testing.TB, open func() func()) {
+			for i := 0; i < 3; i++ {
+				close := open()
+				close()
+				close()
+			}
+		})
+		if n != 0 || msg != nil {
+			t.Errorf("CaptureResourceBalance got (%d, %v), want (0, <none>)", n, fmtMsg(msg))
+		}
+	})
+}
+
+func TestExpectNoResourceLeak(t *testing.T) {
+	ExpectNoResourceLeak(t, func(t testing.TB, open func() func()) {
+		defer open()()
+	})
+
+	got := ExpectFatal(t, func(t testing.TB) {
+		ExpectNoResourceLeak(t, func(t testing.TB, open func() func()) {
+			open()
+			open()
+		})
+	})
+	if want := "left 2 resources open"; !strings.Contains(got, want) {
+		t.Errorf("ExpectNoResourceLeak got msg = %q, want substring %q", got, want)
+	}
+}
+
+func TestExpectFatalMessageCanonical(t *testing.T) {
+	mapRE := regexp.MustCompile(`map\[([^\]]*)\]`)
+	sortMaps := func(msg string) string {
+		return mapRE.ReplaceAllStringFunc(msg, func(m string) string {
+			entries := strings.Fields(mapRE.FindStringSubmatch(m)[1])
+			sort.Strings(entries)
+			return "{" + strings.Join(entries, ", ") + "}"
+		})
+	}
+
+	want := "unexpected counters {in:1, out:2}"
+	for _, formatted := range []string{"map[in:1 out:2]", "map[out:2 in:1]"} {
+		got := ExpectFatalMessageCanonical(t, sortMaps, func(t testing.TB) {
+			t.Fatalf("unexpected counters %s", formatted)
+		})
+		if got != want {
+			t.Errorf("ExpectFatalMessageCanonical got msg = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestExpectCleanupPerResource(t *testing.T) {
+	t.Run("matched", func(t *testing.T) {
+		var closed []string
+		ExpectCleanupPerResource(t, func(t testing.TB, open func() string) {
+			for i := 0; i < 2; i++ {
+				name := open()
+				t.Cleanup(func() { closed = append(closed, name) })
+			}
+		})
+		if want := []string{"resource-2", "resource-1"}; !cmp.Equal(closed, want) {
+			t.Errorf("ExpectCleanupPerResource closed %q, want %q", closed, want)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		ExpectCleanupPerResource(t, func(t testing.TB, open func() string) {
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					name := open()
+					t.Cleanup(func() { t.Logf("closing %s", name) })
+				}()
+			}
+			wg.Wait()
+		})
+	})
+
+	t.Run("with TempDir", func(t *testing.T) {
+		ExpectCleanupPerResource(t, func(t testing.TB, open func() string) {
+			dir := t.TempDir()
+			name := open()
+			t.Cleanup(func() { t.Logf("closing %s in %s", name, dir) })
+		})
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectCleanupPerResource(t, func(t testing.TB, open func() string) {
+				open()
+				name := open()
+				t.Cleanup(func() { t.Logf("closing %s", name) })
+			})
+		})
+		if want := "registered 1 cleanups for 2 opened resources"; !strings.Contains(got, want) {
+			t.Errorf("ExpectCleanupPerResource got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureCPUTime(t *testing.T) {
+	const d = 100 * time.Millisecond
+
+	busyCPU, busyWall, msg := CaptureCPUTime(t, func(t testing.TB) {
+		var n int
+		for start := time.Now(); time.Since(start) < d; n++ {
+		}
+		t.Fatalf("spun %d times", n)
+	})
+	if msg == nil {
+		t.Errorf("CaptureCPUTime got no fatal, want one")
+	}
+	sleepCPU, sleepWall, _ := CaptureCPUTime(t, func(testing.TB) {
+		time.Sleep(d)
+	})
+	if busyWall < d || sleepWall < d {
+		t.Errorf("CaptureCPUTime got wall times %v for a busy loop and %v for a sleep, want both at least %v", busyWall, sleepWall, d)
+	}
+	// The CPU time is a process-wide estimate, so compare the two rather than
+	// checking either against d: the busy loop spins for d on top of whatever
+	// else the process is doing, which the sleep does not.
+	if busyCPU < sleepCPU+d/4 {
+		t.Errorf("CaptureCPUTime got cpu %v for a busy loop and %v for a sleep, want the busy loop well above the sleep", busyCPU, sleepCPU)
+	}
+}
+
+func TestCaptureWithFaultSchedule(t *testing.T) {
+	writeAll := func(t testing.TB, shouldFail func() bool) {
+		for i := 1; i <= 5; i++ {
+			if shouldFail() {
+				t.Fatalf("write %d failed", i)
+			}
+		}
+	}
+
+	msg := CaptureWithFaultSchedule(t, []bool{false, false, true}, writeAll)
+	if want := "write 3 failed"; msg == nil || *msg != want {
+		t.Errorf("CaptureWithFaultSchedule got msg = %v, want %q", fmtMsg(msg), want)
+	}
+	if msg := CaptureWithFaultSchedule(t, []bool{false}, writeAll); msg != nil {
+		t.Errorf("CaptureWithFaultSchedule got msg = %q after the schedule was exhausted, want nil", *msg)
+	}
+}
+
+func TestExpectErrorsInInputOrder(t *testing.T) {
+	items := []string{"", "ok", "", ""}
+	itemRE := regexp.MustCompile(`^item (\d+):`)
+	key := func(msg string) (int, bool) {
+		m := itemRE.FindStringSubmatch(msg)
+		if m == nil {
+			return 0, false
+		}
+		i, err := strconv.Atoi(m[1])
+		return i, err == nil
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		got := ExpectErrorsInInputOrder(t, items, key, func(t testing.TB, items []string) {
+			for i, item := range items {
+				if item == "" {
+					t.Errorf("item %d: empty", i)
+				}
+			}
+			t.Errorf("3 items invalid")
+		})
+		if want := []string{"item 0: empty", "item 2: empty", "item 3: empty", "3 items invalid"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectErrorsInInputOrder got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorsInInputOrder(t, items, key, func(t testing.TB, items []string) {
+				for i := len(items) - 1; i >= 0; i-- {
+					if items[i] == "" {
+						t.Errorf("item %d: empty", i)
+					}
+				}
+			})
+		})
+		if want := `raised error "item 2: empty" for item 2 after error "item 3: empty" for item 3`; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorsInInputOrder got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCapturePartial(t *testing.T) {
+	t.Run("partial results", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		got, msg := CapturePartial(ctx, cancel, t, func(ctx context.Context, t testing.TB) []int {
+			// The first two items are available immediately, after which the
+			// helper waits for more until it is cancelled.
+			source := make(chan int, 2)
+			source <- 0
+			source <- 1
+			var done []int
+			for {
+				select {
+				case i := <-source:
+					done = append(done, i)
+					continue
+				default:
+				}
+				select {
+				case i := <-source:
+					done = append(done, i)
+				case <-ctx.Done():
+					return done
+				}
+			}
+		})
+		if want := []int{0, 1}; msg != nil || !cmp.Equal(got, want) {
+			t.Errorf("CapturePartial got (%v, %v), want (%v, <none>)", got, fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		got, msg := CapturePartial(ctx, cancel, t, func(ctx context.Context, t testing.TB) []int {
+			<-ctx.Done()
+			t.Fatalf("cancelled before any results")
+			return []int{0}
+		})
+		if want := "cancelled before any results"; got != nil || msg == nil || *msg != want {
+			t.Errorf("CapturePartial got (%v, %v), want (nil, %q)", got, fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		got := CapturePanic(t, func(t testing.TB) {
+			CapturePartial(ctx, cancel, t, func(ctx context.Context, t testing.TB) []int {
+				<-ctx.Done()
+				panic("my panic")
+			})
+		})
+		if want := "my panic"; got != want {
+			t.Errorf("CapturePartial panicked with %v, want %q", got, want)
+		}
+	})
+}
+
+func TestExpectErrorsTrimmed(t *testing.T) {
+	tests := []struct {
+		desc      string
+		fn        func(t testing.TB)
+		wantFatal string
+	}{{
+		desc: "Errorf",
+		fn: func(t testing.TB) {
+			t.Errorf("port %d down", 1)
+		},
+	}, {
+		desc: "Error",
+		fn: func(t testing.TB) {
+			t.Error("port 1 down")
+		},
+		wantFatal: `raised error "port 1 down\n" with leading or trailing whitespace`,
+	}, {
+		desc: "Errorf with newline",
+		fn: func(t testing.TB) {
+			t.Errorf("port %d down\n", 1)
+		},
+		wantFatal: `raised error "port 1 down\n"`,
+	}, {
+		desc: "Errorf with indent",
+		fn: func(t testing.TB) {
+			t.Errorf("  port %d down", 1)
+		},
+		wantFatal: `raised error "  port 1 down"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.wantFatal == "" {
+				ExpectErrorsTrimmed(t, tt.fn)
+				return
+			}
+			if got := ExpectFatal(t, func(t testing.TB) { ExpectErrorsTrimmed(t, tt.fn) }); !strings.Contains(got, tt.wantFatal) {
+				t.Errorf("ExpectErrorsTrimmed got msg = %q, want substring %q", got, tt.wantFatal)
+			}
+		})
+	}
+}
+
+func TestExpectErrorTrimmed(t *testing.T) {
+	fn := func(t testing.TB) {
+		t.Error("port", 1, "down")
+		t.Errorf("port %d down", 2)
+		t.Errorf("port %d down\n\n", 3)
+	}
+	// ExpectError returns the messages exactly as formatted.
+	if got, want := ExpectError(t, fn), []string{"port 1 down\n", "port 2 down", "port 3 down\n\n"}; !cmp.Equal(got, want) {
+		t.Errorf("ExpectError got %q, want %q", got, want)
+	}
+	if got, want := ExpectErrorTrimmed(t, fn), []string{"port 1 down", "port 2 down", "port 3 down\n"}; !cmp.Equal(got, want) {
+		t.Errorf("ExpectErrorTrimmed got %q, want %q", got, want)
+	}
+}
+
+func TestExpectFatalAfterFullScan(t *testing.T) {
+	inputs := []string{"a", "", "c", ""}
+
+	t.Run("full scan", func(t *testing.T) {
+		got := ExpectFatalAfterFullScan(t, len(inputs), func(t testing.TB, visit func(int)) {
+			var bad int
+			for i, in := range inputs {
+				visit(i)
+				if in == "" {
+					t.Errorf("input %d empty", i)
+					bad++
+				}
+			}
+			if bad > 0 {
+				t.Fatalf("%d inputs invalid", bad)
+			}
+		})
+		if want := "2 inputs invalid"; got != want {
+			t.Errorf("ExpectFatalAfterFullScan got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("concurrent scan", func(t *testing.T) {
+		got := ExpectFatalAfterFullScan(t, len(inputs), func(t testing.TB, visit func(int)) {
+			var wg sync.WaitGroup
+			for i := range inputs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					visit(i)
+				}(i)
+			}
+			wg.Wait()
+			t.Fatalf("scanned %d inputs", len(inputs))
+		})
+		if want := "scanned 4 inputs"; got != want {
+			t.Errorf("ExpectFatalAfterFullScan got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("aborts early", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalAfterFullScan(t, len(inputs), func(t testing.TB, visit func(int)) {
+				for i, in := range inputs {
+					visit(i)
+					if in == "" {
+						t.Fatalf("input %d empty", i)
+					}
+				}
+			})
+		})
+		if want := `"input 1 empty" before visiting input 2 of 4`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalAfterFullScan got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectRecoveredFatal(t *testing.T) {
+	trigger := func() {
+		var m map[string]int
+		m["eth0"] = 1
+	}
+
+	t.Run("recovers and fatals", func(t *testing.T) {
+		got := ExpectRecoveredFatal(t, trigger, func(t testing.TB, risky func()) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("updating counters: %v", r)
+				}
+			}()
+			risky()
+		})
+		if want := "updating counters: assignment to entry in nil map"; got != want {
+			t.Errorf("ExpectRecoveredFatal got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("panic escapes", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectRecoveredFatal(t, trigger, func(t testing.TB, risky func()) {
+				risky()
+			})
+		})
+		if want := "did not recover from panic: assignment to entry in nil map"; !strings.Contains(got, want) {
+			t.Errorf("ExpectRecoveredFatal got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectOneErrorPerSubject(t *testing.T) {
+	subjectOf := func(msg string) string {
+		return strings.SplitN(msg, ":", 2)[0]
+	}
+
+	t.Run("one per subject", func(t *testing.T) {
+		got := ExpectOneErrorPerSubject(t, subjectOf, func(t testing.TB) {
+			t.Errorf("eth0: down")
+			t.Errorf("eth1: flapping")
+		})
+		if want := map[string]string{"eth0": "eth0: down", "eth1": "eth1: flapping"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectOneErrorPerSubject got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("two for one subject", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectOneErrorPerSubject(t, subjectOf, func(t testing.TB) {
+				t.Errorf("eth0: down")
+				t.Errorf("eth1: flapping")
+				t.Errorf("eth0: no light")
+			})
+		})
+		if want := `raised errors "eth0: down" and "eth0: no light" for the same subject "eth0"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectOneErrorPerSubject got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureWithTicker(t *testing.T) {
+	msg := CaptureWithTicker(t, 3, func(t testing.TB, tick <-chan time.Time) {
+		var polls int
+		for range tick {
+			polls++
+			// The condition being polled for is never met.
+		}
+		t.Fatalf("condition not met after %d polls", polls)
+	})
+	if want := "condition not met after 3 polls"; msg == nil || *msg != want {
+		t.Errorf("CaptureWithTicker got msg = %v, want %q", fmtMsg(msg), want)
+	}
+
+	got := ExpectFatal(t, func(t testing.TB) {
+		CaptureWithTicker(t, -1, func(testing.TB, <-chan time.Time) {})
+	})
+	if want := "got -1 ticks, want at least 0"; !strings.Contains(got, want) {
+		t.Errorf("CaptureWithTicker got msg = %q, want substring %q", got, want)
+	}
+}
+
+func TestExpectCleanupMayLog(t *testing.T) {
+	got := ExpectCleanupMayLog(t, func(t testing.TB) {
+		t.Cleanup(func() { t.Logf("released %s", "dut1") })
+		t.Log("reserved dut1")
+		t.FailNow()
+	})
+	if want := []string{"reserved dut1\n", "released dut1"}; !cmp.Equal(got, want) {
+		t.Errorf("ExpectCleanupMayLog got logs %q, want %q", got, want)
+	}
+
+	msg := ExpectFatal(t, func(t testing.TB) {
+		ExpectCleanupMayLog(t, func(t testing.TB) {
+			t.Cleanup(func() { panic("release failed") })
+		})
+	})
+	if want := "or its cleanups panicked: release failed"; !strings.Contains(msg, want) {
+		t.Errorf("ExpectCleanupMayLog got msg = %q, want substring %q", msg, want)
+	}
+}
+
+func TestCaptureScaling(t *testing.T) {
+	peaks, msgs := CaptureScaling(t, []int{1, 2, 4, 8}, func(t testing.TB, n int, enter, leave func()) {
+		if n > 4 {
+			t.Fatalf("at most 4 workers supported, got %d", n)
+		}
+		runWide(n, enter, leave)
+	})
+	if want := []int{1, 2, 4, 0}; !cmp.Equal(peaks, want) {
+		t.Errorf("CaptureScaling got peaks %v, want %v", peaks, want)
+	}
+	for i, msg := range msgs[:3] {
+		if msg != nil {
+			t.Errorf("CaptureScaling got msg %d = %q, want nil", i, *msg)
+		}
+	}
+	if want := "at most 4 workers supported, got 8"; msgs[3] == nil || *msgs[3] != want {
+		t.Errorf("CaptureScaling got msg 3 = %v, want %q", fmtMsg(msgs[3]), want)
+	}
+}
+
+func TestCaptureInjectError(t *testing.T) {
+	errUnavailable := errors.New("service unavailable")
+
+	t.Run("references error", func(t *testing.T) {
+		msg := CaptureInjectError(t, errUnavailable, func(t testing.TB, op func() error) {
+			if err := op(); err != nil {
+				t.Fatalf("pushing config: %v", fmt.Errorf("attempt 1: %w", err))
+			}
+		})
+		if want := "pushing config: attempt 1: service unavailable"; msg == nil || *msg != want {
+			t.Errorf("CaptureInjectError got msg = %v, want %q", fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("drops error", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureInjectError(t, errUnavailable, func(t testing.TB, op func() error) {
+				if op() != nil {
+					t.Fatal("pushing config failed")
+				}
+			})
+		})
+		if want := `does not reference injected error "service unavailable"`; !strings.Contains(got, want) {
+			t.Errorf("CaptureInjectError got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("ignores error", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureInjectError(t, errUnavailable, func(t testing.TB, op func() error) {
+				op()
+			})
+		})
+		if want := "did not fail fatally on injected error"; !strings.Contains(got, want) {
+			t.Errorf("CaptureInjectError got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("nil error", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureInjectError(t, nil, func(t testing.TB, op func() error) {
+				t.Fatalf("pushing config: %v", op())
+			})
+		})
+		if want := "got nil error to inject"; !strings.Contains(got, want) {
+			t.Errorf("CaptureInjectError got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectNoFormatErrors(t *testing.T) {
+	// Formats are passed in variables to keep vet from flagging the
+	// deliberately malformed ones.
+	tests := []struct {
+		desc      string
+		format    string
+		fatal     bool
+		wantFatal string
+	}{{
+		desc:   "well formed",
+		format: "mtu %d too large",
+	}, {
+		desc:      "wrong verb",
+		format:    "mtu %s too large",
+		wantFatal: `malformed message "mtu %!s(int=9216) too large"`,
+	}, {
+		desc:      "missing argument in fatal",
+		format:    "mtu %d too large for %s",
+		fatal:     true,
+		wantFatal: `malformed message "mtu 9216 too large for %!s(MISSING)"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fn := func(t testing.TB) {
+				if tt.fatal {
+					t.Fatalf(tt.format, 9216)
+				}
+				t.Errorf(tt.format, 9216)
+			}
+			if tt.wantFatal == "" {
+				if got, want := ExpectNoFormatErrors(t, fn), []string{"mtu 9216 too large"}; !cmp.Equal(got, want) {
+					t.Errorf("ExpectNoFormatErrors got %q, want %q", got, want)
+				}
+				return
+			}
+			if got := ExpectFatal(t, func(t testing.TB) { ExpectNoFormatErrors(t, fn) }); !strings.Contains(got, tt.wantFatal) {
+				t.Errorf("ExpectNoFormatErrors got msg = %q, want substring %q", got, tt.wantFatal)
+			}
+		})
+	}
+}
+
+func TestCaptureRetryCount(t *testing.T) {
+	retry := func(n int) func(testing.TB, func() bool) {
+		return func(t testing.TB, attempt func() bool) {
+			for i := 0; i < n; i++ {
+				if attempt() {
+					return
+				}
+			}
+			t.Fatalf("giving up after %d attempts", n)
+		}
+	}
+
+	n, msg := CaptureRetryCount(t, retry(3))
+	if want := 3; n != want {
+		t.Errorf("CaptureRetryCount got %d, want %d", n, want)
+	}
+	if want := "giving up after 3 attempts"; msg == nil || *msg != want {
+		t.Errorf("CaptureRetryCount got msg = %v, want %q", fmtMsg(msg), want)
+	}
+	if got, want := ExpectRetries(t, 3, retry(3)), "giving up after 3 attempts"; got != want {
+		t.Errorf("ExpectRetries got msg = %q, want %q", got, want)
+	}
+
+	got := ExpectFatal(t, func(t testing.TB) { ExpectRetries(t, 3, retry(5)) })
+	if want := "made 5 attempts, want 3"; !strings.Contains(got, want) {
+		t.Errorf("ExpectRetries got msg = %q, want substring %q", got, want)
+	}
+
+	got = ExpectFatal(t, func(t testing.TB) {
+		ExpectRetries(t, 3, func(t testing.TB, attempt func() bool) {
+			for i := 0; i < 3; i++ {
+				attempt()
+			}
+		})
+	})
+	if want := "did not fail fatally after 3 failed attempts"; !strings.Contains(got, want) {
+		t.Errorf("ExpectRetries got msg = %q, want substring %q", got, want)
+	}
+
+	tt := &testT{}
+	if got := ExpectRetries(tt, 0, func(testing.TB, func() bool) {}); got != "" {
+		t.Errorf("ExpectRetries got msg = %q on a non-aborting TB, want empty", got)
+	}
+	if want := "did not fail fatally after 0 failed attempts"; !strings.Contains(tt.got, want) {
+		t.Errorf("ExpectRetries reported %q, want substring %q", tt.got, want)
+	}
+
+	n, _ = CaptureRetryCount(t, func(t testing.TB, attempt func() bool) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				attempt()
+			}()
+		}
+		wg.Wait()
+	})
+	if want := 10; n != want {
+		t.Errorf("CaptureRetryCount got %d concurrent attempts, want %d", n, want)
+	}
+}
+
+// parseLogfmt is a minimal logfmt parser that accepts space-separated
+// key=value pairs with non-empty keys and unquoted values.
+func parseLogfmt(line string) error {
+	for _, pair := range strings.Fields(line) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("malformed pair %q", pair)
+		}
+	}
+	return nil
+}
+
+func TestExpectErrorsParseable(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		got := ExpectErrorsParseable(t, parseLogfmt, func(t testing.TB) {
+			t.Errorf("level=error device=dut1 msg=unreachable")
+		})
+		if len(got) != 1 {
+			t.Errorf("ExpectErrorsParseable got %q, want 1 error", got)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorsParseable(t, parseLogfmt, func(t testing.TB) {
+				t.Errorf("level=error device=dut1")
+				t.Errorf("level=error dut2 unreachable")
+			})
+		})
+		if want := `"level=error dut2 unreachable" that does not parse: malformed pair "dut2"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorsParseable got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectNoFatalInDryRun(t *testing.T) {
+	t.Run("respects dry run", func(t *testing.T) {
+		got := ExpectNoFatalInDryRun(t, func(t testing.TB, dryRun bool) {
+			report := t.Fatalf
+			if dryRun {
+				report = t.Errorf
+			}
+			report("would delete %d interfaces", 2)
+		})
+		if want := []string{"would delete 2 interfaces"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectNoFatalInDryRun got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("fatals regardless", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectNoFatalInDryRun(t, func(t testing.TB, dryRun bool) {
+				t.Fatalf("would delete %d interfaces", 2)
+			})
+		})
+		if want := "failed fatally in dry-run mode: would delete 2 interfaces"; !strings.Contains(got, want) {
+			t.Errorf("ExpectNoFatalInDryRun got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectHelperRespectsDeadline(t *testing.T) {
+	t.Run("respects deadline", func(t *testing.T) {
+		ExpectHelperRespectsDeadline(t, 10*time.Millisecond, func(ctx context.Context, t testing.TB) {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("no response: %v", ctx.Err())
+			case <-time.After(time.Minute):
+			}
+		})
+	})
+
+	t.Run("blocks past deadline", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectHelperRespectsDeadline(t, 10*time.Millisecond, func(ctx context.Context, t testing.TB) {
+				time.Sleep(300 * time.Millisecond)
+			})
+		})
+		if want := "still running 100ms after its 10ms context deadline"; !strings.Contains(got, want) {
+			t.Errorf("ExpectHelperRespectsDeadline got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		got := CapturePanic(t, func(t testing.TB) {
+			ExpectHelperRespectsDeadline(t, 10*time.Millisecond, func(ctx context.Context, t testing.TB) {
+				<-ctx.Done()
+				panic("my panic")
+			})
+		})
+		if want := "my panic"; got != want {
+			t.Errorf("ExpectHelperRespectsDeadline panicked with %v, want %q", got, want)
+		}
+	})
+}
+
+func TestCaptureArtifact(t *testing.T) {
+	got, msg := CaptureArtifact(t, func(t testing.TB, emit func([]byte)) {
+		failed := 1
+		defer func() {
+			emit([]byte(fmt.Sprintf(`{"failed":%d}`, failed)))
+		}()
+		t.Fatalf("%d checks failed", failed)
+	})
+	if want := `{"failed":1}`; string(got) != want {
+		t.Errorf("CaptureArtifact got artifact %q, want %q", got, want)
+	}
+	if want := "1 checks failed"; msg == nil || *msg != want {
+		t.Errorf("CaptureArtifact got msg = %v, want %q", fmtMsg(msg), want)
+	}
+}
+
+func TestExpectErrorsSortedBy(t *testing.T) {
+	rank := map[string]int{"ERROR": 0, "WARN": 1}
+	// Sort by severity, most severe first, then by subject.
+	less := func(a, b string) bool {
+		if ra, rb := rank[severity(a)], rank[severity(b)]; ra != rb {
+			return ra < rb
+		}
+		return a < b
+	}
+	tests := []struct {
+		desc      string
+		errs      []string
+		wantFatal string
+	}{{
+		desc: "sorted",
+		errs: []string{"ERROR: eth0 down", "ERROR: eth1 down", "WARN: eth0 flapping"},
+	}, {
+		desc:      "subjects out of order",
+		errs:      []string{"ERROR: eth1 down", "ERROR: eth0 down"},
+		wantFatal: `raised error "ERROR: eth0 down" after "ERROR: eth1 down"`,
+	}, {
+		desc:      "severities out of order",
+		errs:      []string{"WARN: eth0 flapping", "ERROR: eth1 down"},
+		wantFatal: `raised error "ERROR: eth1 down" after "WARN: eth0 flapping"`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fn := func(t testing.TB) {
+				for _, err := range tt.errs {
+					t.Errorf("%s", err)
+				}
+			}
+			if tt.wantFatal == "" {
+				if got := ExpectErrorsSortedBy(t, less, fn); !cmp.Equal(got, tt.errs) {
+					t.Errorf("ExpectErrorsSortedBy got %q, want %q", got, tt.errs)
+				}
+				return
+			}
+			if got := ExpectFatal(t, func(t testing.TB) { ExpectErrorsSortedBy(t, less, fn) }); !strings.Contains(got, tt.wantFatal) {
+				t.Errorf("ExpectErrorsSortedBy got msg = %q, want substring %q", got, tt.wantFatal)
+			}
+		})
+	}
+}
+
+func TestCaptureAll(t *testing.T) {
+	fatal, errs := CaptureAll(t, func(t testing.TB) {
+		t.Errorf("eth0 down")
+		t.Fatal("giving up")
+	})
+	if want := "giving up\n"; fatal == nil || *fatal != want {
+		t.Errorf("CaptureAll got fatal %v, want %q", fmtMsg(fatal), want)
+	}
+	if want := []string{"eth0 down"}; !cmp.Equal(errs, want) {
+		t.Errorf("CaptureAll got errs %q, want %q", errs, want)
+	}
+
+	if fatal, errs := CaptureAll(t, func(testing.TB) {}); fatal != nil || errs != nil {
+		t.Errorf("CaptureAll got (%v, %q), want (<none>, nil)", fmtMsg(fatal), errs)
+	}
+}
+
+func TestExpectFatalDistinctFromErrors(t *testing.T) {
+	t.Run("distinct", func(t *testing.T) {
+		errs, fatal := ExpectFatalDistinctFromErrors(t, func(t testing.TB) {
+			t.Errorf("eth0 down")
+			t.Errorf("eth1 down")
+			t.Fatalf("%d interfaces down", 2)
+		})
+		if want := []string{"eth0 down", "eth1 down"}; !cmp.Equal(errs, want) || fatal != "2 interfaces down" {
+			t.Errorf("ExpectFatalDistinctFromErrors got (%q, %q), want (%q, %q)", errs, fatal, want, "2 interfaces down")
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalDistinctFromErrors(t, func(t testing.TB) {
+				t.Errorf("eth0 down")
+				t.Fatal("eth0 down")
+			})
+		})
+		if want := `failed fatally with "eth0 down\n", repeating an earlier error`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalDistinctFromErrors got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureWithFlakiness(t *testing.T) {
+	const seed = 2
+	// Derive the flake pattern that the seed produces, to assert the
+	// helper's response to it.
+	rng := rand.New(rand.NewSource(seed))
+	var wantFlakes int
+	for rng.Float64() < 0.5 {
+		wantFlakes++
+	}
+
+	var gotFlakes int
+	msg := CaptureWithFlakiness(t, 0.5, seed, func(t testing.TB, flaky func() bool) {
+		for flaky() {
+			gotFlakes++
+		}
+		t.Fatalf("succeeded after %d flakes", gotFlakes)
+	})
+	if gotFlakes != wantFlakes {
+		t.Errorf("CaptureWithFlakiness produced %d flakes, want %d", gotFlakes, wantFlakes)
+	}
+	if want := fmt.Sprintf("succeeded after %d flakes", wantFlakes); msg == nil || *msg != want {
+		t.Errorf("CaptureWithFlakiness got msg = %v, want %q", fmtMsg(msg), want)
+	}
+
+	if msg := CaptureWithFlakiness(t, 0, seed, func(t testing.TB, flaky func() bool) {
+		for i := 0; i < 100; i++ {
+			if flaky() {
+				t.Fatal("flaked")
+			}
+		}
+	}); msg != nil {
+		t.Errorf("CaptureWithFlakiness got msg = %q with probability 0, want nil", *msg)
+	}
+}
+
+var update = flag.Bool("update", false, "update golden files")
+
+// checkInterfaces reports an error for each line of data that does not
+// configure a valid MTU.
+func checkInterfaces(t testing.TB, data []byte) {
+	t.Helper()
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			t.Errorf("%s: missing mtu", fields[0])
+			continue
+		}
+		mtu, err := strconv.Atoi(strings.TrimPrefix(fields[1], "mtu="))
+		if err != nil || mtu < 68 || mtu > 9216 {
+			t.Errorf("%s: invalid mtu %q", fields[0], fields[1])
+		}
+	}
+}
+
+func TestExpectErrorsForFixture(t *testing.T) {
+	got := ExpectErrorsForFixture(t, filepath.Join("testdata", "interfaces.txt"), checkInterfaces)
+	if len(got) != 3 {
+		t.Errorf("ExpectErrorsForFixture got %q, want 3 errors", got)
+	}
+	if *update {
+		return
+	}
+
+	msg := ExpectFatal(t, func(t testing.TB) {
+		ExpectErrorsForFixture(t, filepath.Join("testdata", "interfaces.txt"), func(t testing.TB, data []byte) {
+			t.Errorf("unexpected error")
+		})
+	})
+	if want := "unexpected errors for fixture"; !strings.Contains(msg, want) {
+		t.Errorf("ExpectErrorsForFixture got msg = %q, want substring %q", msg, want)
+	}
+}
+
+func TestExpectAllGoroutinesJoined(t *testing.T) {
+	t.Run("joins", func(t *testing.T) {
+		msg := ExpectAllGoroutinesJoined(t, func(t testing.TB) {
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					time.Sleep(time.Millisecond)
+				}()
+			}
+			wg.Wait()
+			t.Fatalf("%d workers done", 3)
+		})
+		if want := "3 workers done"; msg == nil || *msg != want {
+			t.Errorf("ExpectAllGoroutinesJoined got msg = %v, want %q", fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("leaves goroutine running", func(t *testing.T) {
+		stop := make(chan struct{})
+		defer close(stop)
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectAllGoroutinesJoined(t, func(t testing.TB) {
+				go func() { <-stop }()
+			})
+		})
+		if want := "left 1 goroutines running"; !strings.Contains(got, want) {
+			t.Errorf("ExpectAllGoroutinesJoined got msg = %q, want substring %q", got, want)
+		}
+		if want := "TestExpectAllGoroutinesJoined"; !strings.Contains(got, want) {
+			t.Errorf("ExpectAllGoroutinesJoined got msg = %q, want stack dump mentioning %q", got, want)
+		}
+	})
+}
+
+func TestExpectFatalMentionsInput(t *testing.T) {
+	t.Run("mentions input", func(t *testing.T) {
+		got := ExpectFatalMentionsInput(t, "eth0\t", func(t testing.TB, in string) {
+			t.Fatalf("invalid interface name %q", in)
+		})
+		if want := `invalid interface name "eth0\t"`; got != want {
+			t.Errorf("ExpectFatalMentionsInput got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("omits input", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalMentionsInput(t, "eth0", func(t testing.TB, in string) {
+				t.Fatal("invalid interface name")
+			})
+		})
+		if want := `does not mention its input "eth0"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalMentionsInput got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectEventSequence(t *testing.T) {
+	// dial emits the states of a connection attempt that fails authentication.
+	dial := func(t testing.TB, emit func(string)) {
+		emit("resolving")
+		emit("connecting")
+		emit("authenticating")
+		emit("closed")
+		t.Fatalf("authentication failed")
+	}
+
+	t.Run("matches", func(t *testing.T) {
+		msg := ExpectEventSequence(t, []string{"resolving", "connecting", "authenticating", "closed"}, dial)
+		if want := "authentication failed"; msg == nil || *msg != want {
+			t.Errorf("ExpectEventSequence got msg = %v, want %q", fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectEventSequence(t, []string{"resolving", "connecting", "connected", "closed"}, dial)
+		})
+		if want := "emitted unexpected events"; !strings.Contains(got, want) {
+			t.Errorf("ExpectEventSequence got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectErrorGrowthBounded(t *testing.T) {
+	sizes := []int{1, 2, 4, 8}
+	linear := func(n int) int { return n }
+
+	t.Run("linear", func(t *testing.T) {
+		got := ExpectErrorGrowthBounded(t, sizes, linear, func(t testing.TB, n int) {
+			for i := 0; i < n; i++ {
+				t.Errorf("item %d invalid", i)
+			}
+		})
+		if want := []int{1, 2, 4, 8}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectErrorGrowthBounded got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("quadratic", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorGrowthBounded(t, sizes, linear, func(t testing.TB, n int) {
+				// Reports every pair of items rather than every item.
+				for i := 0; i < n; i++ {
+					for j := 0; j < n; j++ {
+						t.Errorf("items %d and %d conflict", i, j)
+					}
+				}
+			})
+		})
+		if want := "raised 4 errors for size 2, want at most 2"; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorGrowthBounded got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureCancelAtEachStep(t *testing.T) {
+	const steps = 3
+
+	t.Run("clean", func(t *testing.T) {
+		got := CaptureCancelAtEachStep(t, steps, func(ctx context.Context, t testing.TB, step func()) {
+			for i := 0; i < steps; i++ {
+				if err := ctx.Err(); err != nil {
+					t.Fatalf("stopped before step %d: %v", i, err)
+				}
+				step()
+			}
+		})
+		var msgs []string
+		for _, msg := range got {
+			msgs = append(msgs, fmtMsg(msg))
+		}
+		want := []string{
+			`"stopped before step 0: context canceled"`,
+			`"stopped before step 1: context canceled"`,
+			`"stopped before step 2: context canceled"`,
+			"<none>",
+		}
+		if !cmp.Equal(msgs, want) {
+			t.Errorf("CaptureCancelAtEachStep got msgs %v, want %v", msgs, want)
+		}
+	})
+
+	t.Run("partial state", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureCancelAtEachStep(t, steps, func(ctx context.Context, t testing.TB, step func()) {
+				var conns []string
+				for i := 0; i < steps; i++ {
+					if ctx.Err() != nil {
+						// Assumes the first connection was established.
+						_ = conns[0]
+						return
+					}
+					conns = append(conns, fmt.Sprintf("conn%d", i))
+					step()
+				}
+			})
+		})
+		if want := "panicked when cancelled after 0 steps"; !strings.Contains(got, want) {
+			t.Errorf("CaptureCancelAtEachStep got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureClosesCloser(t *testing.T) {
+	t.Run("closes on fatal", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "interfaces.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := CaptureClosesCloser(t, f, func(t testing.TB, c io.Closer) {
+			defer c.Close()
+			t.Fatalf("no interfaces up")
+		})
+		if want := "no interfaces up"; msg == nil || *msg != want {
+			t.Errorf("CaptureClosesCloser got msg = %v, want %q", fmtMsg(msg), want)
+		}
+		if err := f.Close(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("CaptureClosesCloser did not close the underlying file: Close got err %v, want %v", err, os.ErrClosed)
+		}
+	})
+
+	t.Run("forgets on fatal", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureClosesCloser(t, nil, func(t testing.TB, c io.Closer) {
+				t.Fatalf("no interfaces up")
+				c.Close()
+			})
+		})
+		if want := `did not close its io.Closer (fatal: "no interfaces up")`; !strings.Contains(got, want) {
+			t.Errorf("CaptureClosesCloser got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureReadOnlyFS(t *testing.T) {
+	t.Run("reads", func(t *testing.T) {
+		var got []byte
+		msg := CaptureReadOnlyFS(t, func(t testing.TB, fsys fs.FS) {
+			var err error
+			if got, err = fs.ReadFile(fsys, "interfaces.txt"); err != nil {
+				t.Fatalf("reading interfaces: %v", err)
+			}
+		})
+		if msg != nil {
+			t.Errorf("CaptureReadOnlyFS got msg = %q, want nil", *msg)
+		}
+		if want := "eth0 mtu=1500"; !strings.HasPrefix(string(got), want) {
+			t.Errorf("CaptureReadOnlyFS read %q, want prefix %q", got, want)
+		}
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		msg := CaptureReadOnlyFS(t, func(t testing.TB, fsys fs.FS) {
+			wfs, ok := fsys.(interface {
+				Create(name string) (io.WriteCloser, error)
+			})
+			if !ok {
+				t.Fatalf("cannot write report: %T is read-only", fsys)
+			}
+			wfs.Create("report.txt")
+		})
+		if want := "cannot write report"; msg == nil || !strings.Contains(*msg, want) {
+			t.Errorf("CaptureReadOnlyFS got msg = %v, want substring %q", fmtMsg(msg), want)
+		}
+	})
+}
+
+func TestExpectErrorsHaveRemediation(t *testing.T) {
+	t.Run("helpful", func(t *testing.T) {
+		got := ExpectErrorsHaveRemediation(t, "try:", func(t testing.TB) {
+			t.Errorf("dut1 unreachable; try: check the management interface")
+			t.Errorf("no license; try: gnoi license install")
+		})
+		if len(got) != 2 {
+			t.Errorf("ExpectErrorsHaveRemediation got %q, want 2 errors", got)
+		}
+	})
+
+	t.Run("unhelpful", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorsHaveRemediation(t, "try:", func(t testing.TB) {
+				t.Errorf("dut1 unreachable; try: check the management interface")
+				t.Errorf("no license")
+			})
+		})
+		if want := `raised error "no license" without a remediation hint "try:"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorsHaveRemediation got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectFatalAtBoundary(t *testing.T) {
+	const maxVLANs = 4094
+	checkVLAN := func(t testing.TB, id int) {
+		if id >= maxVLANs {
+			t.Fatalf("VLAN %d out of range", id)
+		}
+	}
+
+	t.Run("at boundary", func(t *testing.T) {
+		got := ExpectFatalAtBoundary(t, maxVLANs-1, maxVLANs, checkVLAN)
+		if want := "VLAN 4094 out of range"; got != want {
+			t.Errorf("ExpectFatalAtBoundary got msg = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("off by one", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalAtBoundary(t, maxVLANs, maxVLANs+1, checkVLAN)
+		})
+		if want := "failed fatally below the boundary, for 4094"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalAtBoundary got msg = %q, want substring %q", got, want)
+		}
+
+		got = ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalAtBoundary(t, maxVLANs-2, maxVLANs-1, checkVLAN)
+		})
+		if want := "did not fail fatally at the boundary, for 4093"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalAtBoundary got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("non-aborting TB", func(t *testing.T) {
+		tt := &testT{}
+		if got := ExpectFatalAtBoundary(tt, maxVLANs-2, maxVLANs-1, checkVLAN); got != "" {
+			t.Errorf("ExpectFatalAtBoundary got msg = %q, want empty", got)
+		}
+		if want := "did not fail fatally at the boundary"; !strings.Contains(tt.got, want) {
+			t.Errorf("ExpectFatalAtBoundary reported %q, want substring %q", tt.got, want)
+		}
+	})
+}
+
+func TestCaptureLogsByVerbosity(t *testing.T) {
+	poll := func(t testing.TB) {
+		t.Log("polling dut1")
+		t.Logf("[V1] sending %d requests", 2)
+		t.Log("[V2] request 1: get /interfaces")
+		t.Log("[V2] request 2: get /system")
+		t.Log("[V1] done")
+	}
+
+	got := CaptureLogsByVerbosity(t, poll)
+	want := map[int][]string{
+		0: {"polling dut1\n"},
+		1: {"[V1] sending 2 requests", "[V1] done\n"},
+		2: {"[V2] request 1: get /interfaces\n", "[V2] request 2: get /system\n"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CaptureLogsByVerbosity got diff (-want +got):\n%s", diff)
+	}
+
+	ExpectMaxVerbosity(t, 2, poll)
+	msg := ExpectFatal(t, func(t testing.TB) {
+		ExpectMaxVerbosity(t, 1, poll)
+	})
+	if want := `logged "[V2] request 1: get /interfaces\n" at verbosity 2, want at most 1`; !strings.Contains(msg, want) {
+		t.Errorf("ExpectMaxVerbosity got msg = %q, want substring %q", msg, want)
+	}
+}
+
+func TestCaptureWithIDSource(t *testing.T) {
+	var sessions []string
+	got, msg := CaptureWithIDSource(t, func(t testing.TB, nextID func() string) {
+		for _, dut := range []string{"dut1", "dut2", "dut3"} {
+			sessions = append(sessions, dut+"/"+nextID())
+		}
+	})
+	if msg != nil {
+		t.Errorf("CaptureWithIDSource got msg = %q, want nil", *msg)
+	}
+	if want := []string{"id-1", "id-2", "id-3"}; !cmp.Equal(got, want) {
+		t.Errorf("CaptureWithIDSource got ids %q, want %q", got, want)
+	}
+	if want := []string{"dut1/id-1", "dut2/id-2", "dut3/id-3"}; !cmp.Equal(sessions, want) {
+		t.Errorf("CaptureWithIDSource helper used ids %q, want %q", sessions, want)
+	}
+}
+
+func TestCaptureLockBalance(t *testing.T) {
+	tests := []struct {
+		desc     string
+		fn       func(t testing.TB, lock, unlock func())
+		wantHeld int
+	}{{
+		desc: "fatal while held",
+		fn: func(t testing.TB, lock, unlock func()) {
+			lock()
+			t.Fatalf("table update failed")
+			unlock()
+		},
+		wantHeld: 1,
+	}, {
+		desc: "deferred unlock",
+		fn: func(t testing.TB, lock, unlock func()) {
+			lock()
+			defer unlock()
+			t.Fatalf("table update failed")
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			held, msg := CaptureLockBalance(t, tt.fn)
+			if held != tt.wantHeld {
+				t.Errorf("CaptureLockBalance got %d locks held, want %d", held, tt.wantHeld)
+			}
+			if want := "table update failed"; msg == nil || *msg != want {
+				t.Errorf("CaptureLockBalance got msg = %v, want %q", fmtMsg(msg), want)
+			}
+		})
+	}
+}
+
+func TestExpectFinalLogMatch(t *testing.T) {
+	statusRE := regexp.MustCompile(`^done: \d+ passed, \d+ failed$`)
+
+	t.Run("final status", func(t *testing.T) {
+		got := ExpectFinalLogMatch(t, statusRE, func(t testing.TB) {
+			t.Logf("checking dut1")
+			t.Logf("checking dut2")
+			t.Logf("done: %d passed, %d failed", 1, 1)
+		})
+		if want := "done: 1 passed, 1 failed"; got != want {
+			t.Errorf("ExpectFinalLogMatch got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("status not last", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFinalLogMatch(t, statusRE, func(t testing.TB) {
+				t.Logf("done: %d passed, %d failed", 1, 1)
+				t.Logf("checking dut3")
+			})
+		})
+		if want := `logged final line "checking dut3"`; !strings.Contains(got, want) {
+			t.Errorf("ExpectFinalLogMatch got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("no logs", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFinalLogMatch(t, statusRE, func(t testing.TB) {})
+		})
+		if want := "logged nothing"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFinalLogMatch got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("no logs on non-aborting TB", func(t *testing.T) {
+		tt := &testT{TB: t}
+		if got := ExpectFinalLogMatch(tt, statusRE, func(t testing.TB) {}); got != "" {
+			t.Errorf("ExpectFinalLogMatch got %q, want empty", got)
+		}
+		if want := "logged nothing"; !strings.Contains(tt.got, want) {
+			t.Errorf("ExpectFinalLogMatch reported %q, want substring %q", tt.got, want)
+		}
+	})
+}
+
+func TestCaptureWithMemoryBudget(t *testing.T) {
+	t.Run("within budget", func(t *testing.T) {
+		msg := CaptureWithMemoryBudget(t, 64<<20, func(t testing.TB) {
+			t.Fatalf("dut1 has %d interfaces", len(make([]int, 16)))
+		})
+		if want := "dut1 has 16 interfaces"; msg == nil || *msg != want {
+			t.Errorf("CaptureWithMemoryBudget got msg = %v, want %q", fmtMsg(msg), want)
+		}
+	})
+
+	t.Run("over budget", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			CaptureWithMemoryBudget(t, 1<<20, func(t testing.TB) {
+				var buffers [][]byte
+				for i := 0; i < 16; i++ {
+					buffers = append(buffers, make([]byte, 1<<20))
+				}
+				time.Sleep(20 * time.Millisecond)
+				// Keep the buffers live until the sampler has seen them.
+				runtime.KeepAlive(buffers)
+			})
+		})
+		if want := "want at most 1048576"; !strings.Contains(got, want) {
+			t.Errorf("CaptureWithMemoryBudget got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("panics", func(t *testing.T) {
+		var r interface{}
+		ExpectAllGoroutinesJoined(t, func(joinT testing.TB) {
+			r = CapturePanic(joinT, func(panicT testing.TB) {
+				CaptureWithMemoryBudget(panicT, 64<<20, func(testing.TB) { panic("my panic") })
+			})
+		})
+		if want := "my panic"; r != want {
+			t.Errorf("CaptureWithMemoryBudget panicked with %v, want %q", r, want)
+		}
+	})
+}
+
+func TestExpectDedupBehavior(t *testing.T) {
+	duts := []string{"dut1", "dut2", "dut1", "dut3", "dut1"}
+	reportDupes := func(t testing.TB, items []string) {
+		seen := make(map[string]bool)
+		for _, item := range items {
+			if seen[item] {
+				t.Errorf("duplicate DUT %s", item)
+			}
+			seen[item] = true
+		}
+	}
+
+	t.Run("dedups silently", func(t *testing.T) {
+		got := ExpectDedupBehavior(t, duts, func(t testing.TB, items []string) {})
+		if len(got) != 0 {
+			t.Errorf("ExpectDedupBehavior got %q, want no errors", got)
+		}
+	})
+
+	t.Run("reports each duplicate", func(t *testing.T) {
+		got := ExpectErrorPerDuplicate(t, duts, reportDupes)
+		if want := []string{"duplicate DUT dut1", "duplicate DUT dut1"}; !cmp.Equal(got, want) {
+			t.Errorf("ExpectErrorPerDuplicate got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("reports once", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectErrorPerDuplicate(t, duts, func(t testing.TB, items []string) {
+				t.Errorf("duplicate DUTs")
+			})
+		})
+		if want := "raised 1 errors for 2 duplicate items"; !strings.Contains(got, want) {
+			t.Errorf("ExpectErrorPerDuplicate got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("no duplicates", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectDedupBehavior(t, []string{"dut1", "dut2"}, reportDupes)
+		})
+		if want := "want at least one duplicate"; !strings.Contains(got, want) {
+			t.Errorf("ExpectDedupBehavior got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestExpectNoLostErrors(t *testing.T) {
+	const n = 50
+	validate := func(t testing.TB) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				t.Errorf("dut%d unreachable", i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	got := ExpectNoLostErrors(t, n, validate)
+	sort.Strings(got)
+	for i := 1; i < len(got); i++ {
+		if got[i] == got[i-1] {
+			t.Errorf("ExpectNoLostErrors got duplicate error %q", got[i])
+		}
+	}
+
+	msg := ExpectFatal(t, func(t testing.TB) {
+		ExpectNoLostErrors(t, n+1, validate)
+	})
+	if want := "raised 50 errors, want 51"; !strings.Contains(msg, want) {
+		t.Errorf("ExpectNoLostErrors got msg = %q, want substring %q", msg, want)
+	}
+}
+
+func TestExpectFatalHasCode(t *testing.T) {
+	codeRE := regexp.MustCompile(`\bE\d{4}\b`)
+
+	t.Run("coded", func(t *testing.T) {
+		gotMsg, gotCode := ExpectFatalHasCode(t, codeRE, func(t testing.TB) {
+			t.Fatalf("E1234: dut1 rejected config")
+		})
+		if wantMsg, wantCode := "E1234: dut1 rejected config", "E1234"; gotMsg != wantMsg || gotCode != wantCode {
+			t.Errorf("ExpectFatalHasCode got (%q, %q), want (%q, %q)", gotMsg, gotCode, wantMsg, wantCode)
+		}
+	})
+
+	t.Run("uncoded", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectFatalHasCode(t, codeRE, func(t testing.TB) {
+				t.Fatalf("dut1 rejected config")
+			})
+		})
+		if want := "has no error code matching"; !strings.Contains(got, want) {
+			t.Errorf("ExpectFatalHasCode got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestParallelError(t *testing.T) {
+	t.Run("errors", func(t *testing.T) {
+		got := ParallelError(t,
+			func(t testing.TB) { t.Errorf("dut1 unreachable") },
+			func(testing.TB) {},
+			func(t testing.TB) {
+				t.Errorf("dut3 unreachable")
+				t.Errorf("dut3 misconfigured")
+			})
+		if want := []string{"dut1 unreachable", "dut3 unreachable", "dut3 misconfigured"}; !cmp.Equal(got, want) {
+			t.Errorf("ParallelError got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		got := ExpectFatal(t, func(t testing.TB) {
+			ParallelError(t,
+				func(t testing.TB) { t.Errorf("dut1 unreachable") },
+				func(t testing.TB) { t.Fatal("dut2 down") })
+		})
+		if want := "1 functions failed fatally: 1 ("; !strings.Contains(got, want) {
+			t.Errorf("ParallelError got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("same function", func(t *testing.T) {
+		down := func(t testing.TB) { t.Fatal("dut down") }
+		got := ExpectFatal(t, func(t testing.TB) {
+			ParallelError(t, down, down, func(testing.TB) {}, down)
+		})
+		for _, want := range []string{"3 functions failed fatally", "0 (", "1 (", "3 ("} {
+			if !strings.Contains(got, want) {
+				t.Errorf("ParallelError got msg = %q, want substring %q", got, want)
+			}
+		}
+	})
+}
+
+func TestExpectSameOutcomeParallelAndSequential(t *testing.T) {
+	duts := []string{"dut1", "dut2", "dut3"}
+
+	t.Run("consistent", func(t *testing.T) {
+		ExpectSameOutcomeParallelAndSequential(t, duts, func(t testing.TB, in string) {
+			if in != "dut2" {
+				t.Errorf("%s unreachable", in)
+			}
+		})
+	})
+
+	t.Run("shared state", func(t *testing.T) {
+		// current is shared by every call, so concurrent calls clobber it.
+		var mu sync.Mutex
+		var current string
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectSameOutcomeParallelAndSequential(t, duts, func(t testing.TB, in string) {
+				mu.Lock()
+				current = in
+				mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				defer mu.Unlock()
+				if current != in {
+					t.Errorf("%s: applied config for %s", in, current)
+				}
+			})
+		})
+		if want := "raised different errors in parallel than sequentially"; !strings.Contains(got, want) {
+			t.Errorf("ExpectSameOutcomeParallelAndSequential got msg = %q, want substring %q", got, want)
+		}
+	})
+}
+
+func TestCaptureCtxReason(t *testing.T) {
+	got := CaptureCtxReason(context.Background(), "maintenance window", t, func(ctx context.Context, t testing.TB) {
+		<-ctx.Done()
+		reason, ok := CancelReason(ctx)
+		if !ok {
+			reason = "unknown"
+		}
+		t.Logf("polling cancelled: %v (reason: %s)", ctx.Err(), reason)
+		t.Fatalf("dut1 not polled")
+	})
+	want := []string{"polling cancelled: context canceled (reason: maintenance window)", "dut1 not polled"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("CaptureCtxReason got %q, want %q", got, want)
+	}
+
+	if reason, ok := CancelReason(context.Background()); ok {
+		t.Errorf("CancelReason got (%q, true) for a context without a reason, want false", reason)
+	}
+}
+
+func TestExpectConsistentSeverity(t *testing.T) {
+	t.Run("stable", func(t *testing.T) {
+		ExpectConsistentSeverity(t, 3, func(t testing.TB) {
+			t.Errorf("dut1 slow to respond")
+		})
+	})
+
+	t.Run("flips on timeout", func(t *testing.T) {
+		// Each run takes a second longer than the last, so later runs exceed
+		// the timeout.
+		clock := &fakeClock{now: time.Unix(0, 0).UTC()}
+		start := clock.Now()
+		got := ExpectFatal(t, func(t testing.TB) {
+			ExpectConsistentSeverity(t, 3, func(t testing.TB) {
+				clock.Advance(time.Second)
+				if elapsed := clock.Now().Sub(start); elapsed > 2*time.Second {
+					t.Fatalf("dut1 timed out after %v", elapsed)
+				}
+				t.Errorf("dut1 slow to respond")
+			})
+		})
+		if want := "failed fatally in 1 of 3 runs: [error error fatal]"; !strings.Contains(got, want) {
+			t.Errorf("ExpectConsistentSeverity got msg = %q, want substring %q", got, want)
+		}
+	})
+
+	t.Run("no runs", func(t *testing.T) {
+		for _, runs := range []int{0, -1} {
+			got := ExpectFatal(t, func(t testing.TB) {
+				ExpectConsistentSeverity(t, runs, func(t testing.TB) { t.Fatal("dut1 down") })
+			})
+			if want := fmt.Sprintf("got %d runs, want at least 1", runs); !strings.Contains(got, want) {
+				t.Errorf("ExpectConsistentSeverity got msg = %q, want substring %q", got, want)
+			}
+		}
+	})
+}
+
+func TestCaptureMetrics(t *testing.T) {
+	got, msg := CaptureMetrics(t, func(t testing.TB, inc func(string, float64)) {
+		for _, dut := range []string{"dut1", "dut2"} {
+			inc("polls_total", 1)
+			inc("poll_seconds", 0.25)
+			if dut == "dut2" {
+				inc("poll_failures_total", 1)
+				t.Fatalf("%s unreachable", dut)
+			}
+		}
+	})
+	want := map[string]float64{"polls_total": 2, "poll_seconds": 0.5, "poll_failures_total": 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CaptureMetrics got diff (-want +got):\n%s", diff)
+	}
+	if want := "dut2 unreachable"; msg == nil || *msg != want {
+		t.Errorf("CaptureMetrics got msg = %v, want %q", fmtMsg(msg), want)
+	}
+}